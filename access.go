@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"net"
+)
+
+// A CredentialStore validates the credentials clients present to a Server
+// using username/password authentication.  Valid may be called by multiple
+// goroutines simultaneously.
+type CredentialStore interface {
+	Valid(user, password string) bool
+}
+
+// StaticCredentials is a CredentialStore mapping usernames to passwords.
+type StaticCredentials map[string]string
+
+// Valid reports whether password is the password of user.  The comparison
+// takes constant time, so as not to reveal how much of a guessed password is
+// right.
+func (c StaticCredentials) Valid(user, password string) bool {
+	expected, ok := c[user]
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && ok
+}
+
+// Rules decide which requests a Server serves.  Allow is called with the
+// address of the client and the destination and command of each request,
+// after the client has authenticated.  For BIND, dst is the address of the
+// peer the client expects; for UDP ASSOCIATE, Allow is called for each
+// destination the client sends datagrams to, and those it may not send to
+// are dropped.  Requests which are not allowed are answered with
+// ReplyNotAllowed.  Allow may be called by multiple goroutines
+// simultaneously.
+type Rules interface {
+	Allow(client net.Addr, dst *Addr, cmd Command) bool
+}
+
+// RuleFunc is an adapter to allow the use of an ordinary function as Rules.
+type RuleFunc func(client net.Addr, dst *Addr, cmd Command) bool
+
+// Allow calls f(client, dst, cmd).
+func (f RuleFunc) Allow(client net.Addr, dst *Addr, cmd Command) bool {
+	return f(client, dst, cmd)
+}
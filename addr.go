@@ -0,0 +1,151 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+)
+
+// Addr is an address as it appears in SOCKS5 messages: either an IP address
+// or a domain name, and a port.
+type Addr struct {
+	Name	string	// domain name; only used if IP is nil
+	IP		net.IP
+	Port	int
+}
+
+// Network returns "socks".
+func (a *Addr) Network() string {
+	return "socks"
+}
+
+func (a *Addr) String() string {
+	host := a.Name
+	if a.IP != nil {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+// maxAddrLen is the length of the longest possible ATYP, ADDR and PORT
+// fields: a 255-byte domain name with its length.
+const maxAddrLen = 1 + 1 + 0xFF + 2
+
+// parseAddr parses an address in the format expected by net.SplitHostPort.
+// IP literals are recognized as such, so that they can be sent to the proxy
+// as IPv4 or IPv6 addresses rather than as domain names.
+func parseAddr(addr string) (*Addr, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: int(port)}, nil
+	}
+	return &Addr{Name: host, Port: int(port)}, nil
+}
+
+// appendTo appends the ATYP, DST.ADDR and DST.PORT fields describing a to b.
+// It fails with ErrInvalidAddr rather than encode an address the other end
+// would misread.
+func (a *Addr) appendTo(b []byte) ([]byte, error) {
+	if a.Port < 0 || a.Port > 0xFFFF {
+		return nil, ErrInvalidAddr
+	}
+	if ip4 := a.IP.To4(); ip4 != nil {
+		b = append(b, socks5IPv4Addr)
+		b = append(b, ip4...)
+	} else if a.IP != nil {
+		if len(a.IP) != net.IPv6len {
+			return nil, ErrInvalidAddr
+		}
+		b = append(b, socks5IPv6Addr)
+		b = append(b, a.IP...)
+	} else {
+		if a.Name == "" {
+			return nil, ErrInvalidAddr
+		}
+		if len(a.Name) > 0xFF {
+			return nil, ErrHostnameTooLong
+		}
+		b = append(b, socks5DomainName, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(a.Port)), nil
+}
+
+// parseAddrField parses the ATYP, DST.ADDR and DST.PORT fields at the start of
+// b.  It returns the address and the number of bytes it occupied.
+func parseAddrField(b []byte) (*Addr, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrShortMessage
+	}
+	var a Addr
+	var n int
+	switch b[0] {
+		case socks5IPv4Addr:
+			n = 1 + net.IPv4len
+			if len(b) < n+2 {
+				return nil, 0, ErrShortMessage
+			}
+			a.IP = net.IP(append([]byte(nil), b[1:n]...))
+		case socks5IPv6Addr:
+			n = 1 + net.IPv6len
+			if len(b) < n+2 {
+				return nil, 0, ErrShortMessage
+			}
+			a.IP = net.IP(append([]byte(nil), b[1:n]...))
+		case socks5DomainName:
+			if len(b) < 2 {
+				return nil, 0, ErrShortMessage
+			}
+			if b[1] == 0 {
+				return nil, 0, &ProtocolError{ErrInvalidAddr, 0}
+			}
+			n = 2 + int(b[1])
+			if len(b) < n+2 {
+				return nil, 0, ErrShortMessage
+			}
+			a.Name = string(b[2:n])
+		default:
+			return nil, 0, &ProtocolError{ErrAddrType, b[0]}
+	}
+	a.Port = int(binary.BigEndian.Uint16(b[n:]))
+	return &a, n + 2, nil
+}
+
+// readAddrField reads ATYP, ADDR and PORT fields from r, and appends them to b
+// as they are.  If reading fails, the bytes read so far are still appended.
+func readAddrField(r io.Reader, b []byte) ([]byte, error) {
+	start := len(b)
+	b = append(b, 0)
+	n, err := readFull(r, b[start:], true)
+	if err != nil {
+		return b[:start+n], err
+	}
+	var addrLen int
+	switch b[start] {
+		case socks5IPv4Addr:
+			addrLen = net.IPv4len
+		case socks5IPv6Addr:
+			addrLen = net.IPv6len
+		case socks5DomainName:
+			b = append(b, 0)
+			n, err = readFull(r, b[start+1:], true)
+			if err != nil {
+				return b[:start+1+n], err
+			}
+			addrLen = int(b[start+1])
+			if addrLen == 0 {
+				return b, &ProtocolError{ErrInvalidAddr, 0}
+			}
+		default:
+			return b, &ProtocolError{ErrAddrType, b[start]}
+	}
+	end := len(b)
+	b = slices.Grow(b, addrLen+2)[:end+addrLen+2]
+	n, err = readFull(r, b[end:], true)
+	return b[:end+n], err
+}
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAddrMarshal(t *testing.T) {
+	tests := []struct {
+		addr	*Addr
+		want	[]byte
+		err		error
+	}{
+		{&Addr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, []byte{0x01, 127, 0, 0, 1, 0, 80}, nil},
+		{&Addr{IP: net.IP{10, 0, 0, 1}, Port: 0xFFFF}, []byte{0x01, 10, 0, 0, 1, 0xFF, 0xFF}, nil},
+		{
+			&Addr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			[]byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xBB},
+			nil,
+		},
+		{&Addr{Name: "example.com", Port: 1080}, append([]byte{0x03, 11}, "example.com\x04\x38"...), nil},
+		{&Addr{IP: net.IP{1, 2, 3}, Port: 80}, nil, ErrInvalidAddr},
+		{&Addr{IP: make(net.IP, 8), Port: 80}, nil, ErrInvalidAddr},
+		{&Addr{IP: net.IPv4(127, 0, 0, 1), Port: 70000}, nil, ErrInvalidAddr},
+		{&Addr{IP: net.IPv4(127, 0, 0, 1), Port: -1}, nil, ErrInvalidAddr},
+		{&Addr{Port: 80}, nil, ErrInvalidAddr},
+		{&Addr{Name: strings.Repeat("a", 256), Port: 80}, nil, ErrHostnameTooLong},
+	}
+	for _, tt := range tests {
+		b, err := (&Request{Command: CommandConnect, Dst: tt.addr}).Marshal()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%#v: got error %v, want %v", tt.addr, err, tt.err)
+			continue
+		}
+		if err == nil && string(b[3:]) != string(tt.want) {
+			t.Errorf("%#v: encoded as % x, want % x", tt.addr, b[3:], tt.want)
+		}
+	}
+}
+
+func TestUnmarshalEmptyName(t *testing.T) {
+	b := []byte{0x05, 0x01, 0x00, 0x03, 0x00, 0x00, 0x50}
+	var q Request
+	_, err := q.Unmarshal(b)
+	if !errors.Is(err, ErrInvalidAddr) {
+		t.Errorf("Unmarshal: got %v, want ErrInvalidAddr", err)
+	}
+	_, err = q.ReadFrom(bytes.NewReader(b))
+	if !errors.Is(err, ErrInvalidAddr) {
+		t.Errorf("ReadFrom: got %v, want ErrInvalidAddr", err)
+	}
+}
+
+func TestDialInvalidAddr(t *testing.T) {
+	d := &Dialer{ProxyAddr: startServer(t, &Server{})}
+	_, err := d.Dial("tcp", ":80")
+	if !errors.Is(err, ErrInvalidAddr) {
+		t.Errorf("got %v, want ErrInvalidAddr", err)
+	}
+}
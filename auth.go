@@ -0,0 +1,90 @@
+package socks
+
+import (
+	"net"
+)
+
+const socks5AuthVersion byte	= 0x01
+const socks5AuthSuccess byte	= 0x00
+
+// An AuthMethod is an authentication method a Dialer can offer to the proxy.
+// Implementing this interface allows methods other than the ones in this
+// package, such as private methods in the range 0x80 to 0xFE, to be used.
+type AuthMethod interface {
+	// Method returns the METHOD value identifying the method.
+	Method() byte
+
+	// Negotiate is called once the proxy has selected the method, and
+	// performs the method-specific sub-negotiation on conn.  It returns the
+	// connection to use for the rest of the session, which is conn itself
+	// unless the method encapsulates traffic.
+	Negotiate(conn net.Conn) (net.Conn, error)
+}
+
+// NoAuthentication is the AuthMethod for proxies which do not require
+// authentication.
+var NoAuthentication AuthMethod = noAuthentication{}
+
+type noAuthentication struct{}
+
+func (noAuthentication) Method() byte {
+	return socks5NoAuthentication
+}
+
+func (noAuthentication) Negotiate(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// Auth contains the credentials for username/password authentication, as
+// described in RFC 1929.  *Auth implements AuthMethod.
+type Auth struct {
+	User		string
+	Password	string
+}
+
+// Method returns 0x02, the METHOD value of username/password authentication.
+func (a *Auth) Method() byte {
+	return socks5UsernamePassword
+}
+
+// Negotiate performs the username/password sub-negotiation on conn.
+func (a *Auth) Negotiate(conn net.Conn) (net.Conn, error) {
+	err := a.authenticate(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (a *Auth) authenticate(conn net.Conn) error {
+	if len(a.User) == 0 || len(a.User) > 0xFF || len(a.Password) > 0xFF {
+		return ErrInvalidCredentials
+	}
+
+	req := make([]byte, 0, 3+len(a.User)+len(a.Password))
+	req = append(req, socks5AuthVersion, byte(len(a.User)))
+	req = append(req, a.User...)
+	req = append(req, byte(len(a.Password)))
+	req = append(req, a.Password...)
+	_, err := conn.Write(req)
+	// don't leave the plaintext password lying around in the heap
+	for i := range req {
+		req[i] = 0
+	}
+	if err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	_, err = readFull(conn, resp[:], false)
+	if err != nil {
+		return err
+	}
+	if resp[0] != socks5AuthVersion {
+		return &ProtocolError{ErrAuthVersion, resp[0]}
+	}
+	if resp[1] != socks5AuthSuccess {
+		return &ProtocolError{ErrAuthFailed, resp[1]}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// Bind asks the proxy to listen for a connection from targetAddr, the address
+// of the peer which is expected to connect.  This is what protocols such as
+// FTP in active mode need.  The address the proxy is listening on is available
+// from the returned Binding's Addr method, and should be communicated to the
+// peer, after which Accept waits for the peer to connect.  The context only
+// governs the BIND request and the proxy's first reply.  If d.Resolve is
+// ResolveLocal, targetAddr's host name is resolved locally.
+func (d *Dialer) Bind(ctx context.Context, targetAddr string) (*Binding, error) {
+	dst, err := parseAddr(targetAddr)
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, d.ProxyAddr, targetAddr, err)
+	}
+	c, err := d.dial(ctx, "tcp", CommandBind, dst)
+	if err != nil {
+		return nil, err
+	}
+	conn, bound := c.Conn, c.boundAddr
+
+	// As with UDP ASSOCIATE, an unspecified address means the proxy is
+	// listening on the address we reached it at.
+	if bound.IP.IsUnspecified() {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			bound.IP = tcpAddr.IP
+		}
+	}
+	return &Binding{
+		conn:	conn,
+		proxy:	c.proxy,
+		socks4:	c.socks4,
+		target:	dst.String(),
+		addr:	bound,
+		id:		c.id,
+	}, nil
+}
+
+// A Binding is a pending BIND request, returned by Dialer.Bind.
+type Binding struct {
+	conn		net.Conn
+	proxy		string
+	socks4		bool
+	target		string
+	addr		*Addr
+	peer		*Addr
+	accepted	bool
+	id			string
+}
+
+// Addr returns the address the proxy is listening on for the peer's
+// connection, as reported in its first reply.
+func (b *Binding) Addr() net.Addr {
+	return b.addr
+}
+
+// Accept waits for the proxy's second reply, which it sends once the peer has
+// connected, and returns the connection to the peer, a *Conn whose BoundAddr
+// is the same as Addr, and whose RemoteAddr is the same as PeerAddr.  Accept
+// may only be called once.  If ctx is done before the peer connects, the
+// Binding is no longer usable and should be closed.  Any error returned is a
+// *HandshakeError.
+func (b *Binding) Accept(ctx context.Context) (net.Conn, error) {
+	var peer *Addr
+	var err error
+	stop := watchContext(ctx, b.conn)
+	if b.socks4 {
+		peer, err = readSocks4Reply(b.conn)
+	} else {
+		peer, err = readReply(b.conn, nil, ContextClientTrace(ctx))
+	}
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, b.proxy, b.target, err).withID(b.id)
+	}
+	b.peer = peer
+	b.accepted = true
+	return &Conn{Conn: b.conn, boundAddr: b.addr, proxy: b.proxy, target: peer, id: b.id}, nil
+}
+
+// PeerAddr returns the address of the peer which connected, as reported by
+// the proxy, or nil if Accept has not succeeded.
+func (b *Binding) PeerAddr() net.Addr {
+	if b.peer == nil {
+		return nil
+	}
+	return b.peer
+}
+
+// Close abandons the BIND request by closing the connection to the proxy.
+// Once Accept has succeeded, the connection belongs to the caller, and Close
+// does nothing.
+func (b *Binding) Close() error {
+	if b.accepted {
+		return nil
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,136 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Conn is a connection established through a SOCKS5 proxy.  The connections
+// returned by the Dial functions are of this type.
+type Conn struct {
+	net.Conn
+	boundAddr	*Addr
+	proxy		string
+	socks4		bool	// SOCKS4 or SOCKS4a was spoken to the proxy
+	target		*Addr
+	counter		*connCounter	// nil unless the Dialer has Metrics or ReportThroughput
+	id			string
+}
+
+// DialID returns the ID of the dial which established the connection; see
+// WithDialID.
+func (c *Conn) DialID() string {
+	return c.id
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.counter != nil {
+		c.counter.read.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.counter != nil {
+		c.counter.written.Add(int64(n))
+	}
+	return n, err
+}
+
+// Close closes the connection to the proxy.  If the Dialer has Metrics, the
+// first call reports the bytes read and written to it.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	if c.counter != nil {
+		c.counter.close()
+	}
+	return err
+}
+
+// RemoteAddr returns the address of the target, as it was requested: an
+// *Addr holding the target's host name, unless it was given as an IP
+// address.  The address of the proxy is available from ProxyAddr.
+// LocalAddr is that of the connection to the proxy.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.target
+}
+
+// ProxyAddr returns the address of the other end of the connection to the
+// proxy, that is, the RemoteAddr of the underlying connection.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// Proxy returns the address of the proxy the connection goes through: the
+// Dialer's ProxyAddr, or whichever of its FallbackProxyAddrs was used.
+func (c *Conn) Proxy() string {
+	return c.proxy
+}
+
+// BoundAddr returns the address the proxy reported in its reply: for CONNECT,
+// the address the proxy uses for its connection to the target.
+func (c *Conn) BoundAddr() net.Addr {
+	return c.boundAddr
+}
+
+// NetConn returns the connection to the proxy which c wraps.  This is
+// usually a *net.TCPConn, but it may be a *tls.Conn, or a connection of an
+// authentication method which encapsulates traffic.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection to the proxy,
+// which in turn passes the half-close on to the target, while data can still
+// be read from it.  It fails with errors.ErrUnsupported if the underlying
+// connection has no CloseWrite method.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// CloseRead shuts down the reading side of the connection to the proxy.  It
+// fails with errors.ErrUnsupported if the underlying connection has no
+// CloseRead method, as is the case for *tls.Conn.
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errors.ErrUnsupported
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy can still use the
+// underlying connection's optimizations (e.g. sendfile for *net.TCPConn).
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+	if c.counter != nil {
+		c.counter.written.Add(n)
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, for the same reason as ReadFrom.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var err error
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		n, err = wt.WriteTo(w)
+	} else {
+		n, err = io.Copy(w, struct{ io.Reader }{c.Conn})
+	}
+	if c.counter != nil {
+		c.counter.read.Add(n)
+	}
+	return n, err
+}
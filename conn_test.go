@@ -0,0 +1,144 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialFunc is an adapter to allow the use of an ordinary function as a
+// ContextDialer.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// noHalfClose dials TCP connections which hide their CloseWrite and
+// CloseRead methods.
+var noHalfClose = dialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ net.Conn }{conn}, nil
+})
+
+// startSink runs a TCP server which reads each connection until EOF, and then
+// sends the number of bytes read on the returned channel.
+func startSink(t *testing.T) (string, <-chan int64) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got := make(chan int64, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				got <- n
+			}()
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestConnHalfClose(t *testing.T) {
+	d := &Dialer{ProxyAddr: startServer(t, &Server{}), Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*Conn)
+	if _, ok := c.NetConn().(*net.TCPConn); !ok {
+		t.Errorf("NetConn() is a %T, want a *net.TCPConn", c.NetConn())
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the echo server only closes once it has seen EOF
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("half-close did not reach the target: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q back, want \"hello\"", got)
+	}
+
+	conn, err = d.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.(*Conn).CloseRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("Read after CloseRead: got %v, want io.EOF", err)
+	}
+}
+
+func TestConnHalfCloseUnsupported(t *testing.T) {
+	sink, got := startSink(t)
+	inner := &Dialer{ProxyAddr: startServer(t, &Server{}), Forward: noHalfClose, Timeout: 5 * time.Second}
+	conn, err := inner.Dial("tcp", sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*Conn)
+	if err := c.CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite: got %v, want errors.ErrUnsupported", err)
+	}
+	if err := c.CloseRead(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseRead: got %v, want errors.ErrUnsupported", err)
+	}
+	conn.Close()
+	<-got	// from the connection just closed
+
+	// a Server dialing through another proxy over such a transport must
+	// still pass the client's half-close on
+	outer := &Server{DialContext: inner.DialContext}
+	d := &Dialer{ProxyAddr: startServer(t, outer), Timeout: 5 * time.Second}
+	conn, err = d.Dial("tcp", sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*Conn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case n := <-got:
+			if n != 5 {
+				t.Errorf("target read %d bytes, want 5", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("the target never saw EOF")
+	}
+}
@@ -0,0 +1,745 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ContextDialer is the interface of dialers which take a context.  It has the
+// same method set as golang.org/x/net/proxy.ContextDialer, so values of either
+// type can be used as the other.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// *Dialer implements both golang.org/x/net/proxy.Dialer and
+// proxy.ContextDialer.  The interfaces are spelled out here so that this
+// package doesn't need to depend on x/net.
+var (
+	_ interface {
+		Dial(network, address string) (net.Conn, error)
+	} = (*Dialer)(nil)
+	_ ContextDialer = (*Dialer)(nil)
+)
+
+// ResolveMode says where the host names of targets are resolved.
+type ResolveMode int
+
+const (
+	ResolveRemote	ResolveMode = iota	// the proxy resolves host names
+	ResolveLocal						// host names are resolved before contacting the proxy
+)
+
+// A Dialer connects to targets through a SOCKS5 proxy.  A Dialer may be used
+// by multiple goroutines simultaneously, but its fields should not be
+// modified once it is in use.
+type Dialer struct {
+	// ProxyAddr is the address of the proxy, in the format expected by
+	// net.SplitHostPort.
+	ProxyAddr	string
+
+	// Version is the protocol version spoken to the proxy.  With SOCKS4 and
+	// SOCKS4a, only CONNECT and BIND are available, AuthMethods is not used,
+	// and Auth.User, if Auth is set, is sent as the user ID.  VersionAuto
+	// reconnects using SOCKS4a if the proxy rejects the SOCKS5 greeting,
+	// except in Client, where it is the same as VersionSocks5.
+	Version		Version
+
+	// Auth, if not nil, holds the credentials used if the proxy asks for
+	// username/password authentication.
+	Auth		*Auth
+
+	// AuthMethods, if not nil, lists the authentication methods offered to
+	// the proxy, in order of preference.  It overrides the default of
+	// offering NoAuthentication, followed by Auth if it is not nil.
+	AuthMethods	[]AuthMethod
+
+	// Timeout is the maximum amount of time a dial will wait for both the
+	// connection to the proxy and the SOCKS handshake to complete.  Zero
+	// means no timeout, though a deadline on the context passed to
+	// DialContext still applies.
+	Timeout		time.Duration
+
+	// Deadline, if not zero, is the absolute time by which a dial must be
+	// complete.  It applies in addition to Timeout.
+	Deadline	time.Time
+
+	// ConnectTimeout, if not zero, limits how long connecting to the proxy
+	// (or to a target bypassing it) may take, within the overall limit.
+	ConnectTimeout	time.Duration
+
+	// HandshakeTimeout, if not zero, limits how long the TLS handshake, if
+	// any, and the SOCKS handshake may take once connected to the proxy,
+	// within the overall limit.  It guards against proxies which accept
+	// connections but then stall, or trickle out their replies.
+	HandshakeTimeout	time.Duration
+
+	// KeepAlive, if not zero, is the keep-alive period of connections to
+	// the proxy and to targets bypassing it, overriding NetDialer's; negative
+	// values disable keep-alive probes.  It has the same meaning as
+	// net.Dialer.KeepAlive.
+	KeepAlive	time.Duration
+
+	// FallbackDelay, if not zero, overrides NetDialer's FallbackDelay: when
+	// the proxy's host name has both IPv6 and IPv4 addresses, how long to
+	// wait for a connection over the preferred family (usually IPv6) before
+	// racing one over the other (RFC 8305, "Happy Eyeballs").  Negative
+	// values disable the race, so that the addresses are tried one after
+	// another.  If neither is set, net's default of 300ms applies.
+	FallbackDelay	time.Duration
+
+	// Pipeline, if set, makes the Dialer send its request to the proxy
+	// together with the greeting, without waiting for the proxy to select
+	// an authentication method, which saves a round trip.  It only takes
+	// effect when NoAuthentication is the only method offered, and only
+	// works with proxies which read the request after answering the
+	// greeting, as the protocol allows, rather than discarding it.  Over a
+	// synchronous transport such as net.Pipe, where a Write blocks until the
+	// other end has read all of it, the proxy must also keep reading while it
+	// answers the greeting, or the handshake deadlocks.
+	Pipeline	bool
+
+	// PrepareRequest, if not nil, is called with each SOCKS5 request before
+	// it is sent, and may change its Command and Dst, or return bytes to
+	// send right after it, in the same write, for proxies with proprietary
+	// extensions.  It sees the target after any local resolution, and must
+	// not retain req.  If it returns an error, the dial fails with it.  It
+	// is not called for SOCKS4.
+	PrepareRequest	func(req *Request) (trailer []byte, err error)
+
+	// ConnTimeout, if not zero, bounds the lifetime of connections returned
+	// by the Dialer: their deadline is set to ConnTimeout after the handshake
+	// completed.  Otherwise the deadline used for the handshake is cleared,
+	// and the returned connection has no deadline.
+	ConnTimeout	time.Duration
+
+	// Resolve says whether target host names are sent to the proxy, or
+	// resolved locally and sent to the proxy as IP addresses.  It applies to
+	// Dial and Bind; PacketConn.WriteTo always sends addresses as given.
+	// When a name resolves to several addresses, they are tried in order,
+	// like net.Dialer does, for as long as the proxy refuses the request
+	// with a reply code, as it does when it cannot reach the address.
+	// Client only tries the first address, as it has a single connection to
+	// the proxy to work with.
+	Resolve		ResolveMode
+
+	// Resolver is used to resolve target host names when Resolve is
+	// ResolveLocal.  If nil, net.DefaultResolver is used.
+	Resolver	Resolver
+
+	// DisableIDNA, if set, makes the Dialer send target host names as they
+	// are given, including the destinations of datagrams sent with
+	// PacketConn.WriteTo.  Otherwise, internationalized domain names are
+	// converted to their ASCII form ("xn--" labels encoded with Punycode)
+	// before they are resolved or sent to the proxy, as most proxies expect.
+	DisableIDNA	bool
+
+	// Bypass, if not nil, is called with the target address passed to Dial
+	// or DialContext.  If it returns true, the target is dialed directly
+	// rather than through the proxy, and the connection and any error are
+	// returned as they come from the net package.
+	Bypass		func(addr string) bool
+
+	// TLSConfig, if not nil, makes the Dialer connect to the proxy over TLS
+	// using this configuration, before starting the SOCKS handshake.  If
+	// its ServerName is empty, the host part of ProxyAddr is used both for
+	// SNI and for verifying the proxy's certificate.
+	TLSConfig	*tls.Config
+
+	// Forward, if not nil, is used to connect to the proxy instead of
+	// NetDialer.  It may be another *Dialer, in which case the connection to
+	// this proxy is tunnelled through that one; see also Chain.
+	Forward		ContextDialer
+
+	// NetDialer, if not nil, is used to connect to the proxy, and to targets
+	// bypassing it.  If it has a Timeout or Deadline of its own, those apply
+	// to connecting in addition to Timeout.
+	NetDialer	*net.Dialer
+
+	// FallbackProxyAddrs lists further proxies to try, in order, when
+	// connecting through ProxyAddr fails with an error Retry accepts.  They
+	// are used with the same configuration as ProxyAddr, and all attempts
+	// share the time allowed by Timeout and the context.
+	FallbackProxyAddrs	[]string
+
+	// Retry, if not nil, is called with the error of a failed attempt, and
+	// says whether the next proxy in FallbackProxyAddrs should be tried.  If
+	// nil, (*HandshakeError).Transient is used.
+	Retry		func(err *HandshakeError) bool
+
+	// Metrics, if not nil, is told about every dial through the proxy, and
+	// the connections returned by Dial, DialContext and Client count the
+	// bytes passing through them and report them to it when closed.
+	// Connections bypassing the proxy are not included.
+	Metrics		Metrics
+
+	// ReportThroughput, if not nil, is called every ThroughputInterval for
+	// each connection returned by Dial, DialContext and Client, with the
+	// bytes transferred so far and the recent transfer rates, until the
+	// connection is closed.  It is called from a goroutine of its own, one
+	// call at a time for each connection, and no call starts once Close has
+	// been called.  ThroughputInterval must be positive for ReportThroughput
+	// to be used.
+	ReportThroughput	func(stats *DialStats, t Throughput)
+	ThroughputInterval	time.Duration
+}
+
+// Dial connects to addr through the proxy.  Only the "tcp", "tcp4" and "tcp6"
+// networks are supported.  The returned connection is a *Conn.  Any error
+// returned is a *HandshakeError.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialTimeout is like Dial, but uses the supplied timeout instead of
+// d.Timeout.
+func (d *Dialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	dd := *d
+	dd.Timeout = timeout
+	return dd.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but uses the supplied context.  If the context is
+// cancelled or its deadline expires before the connection to the proxy and
+// the SOCKS handshake are complete, the dial is aborted and the returned error
+// wraps the context's error.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, newHandshakeError(StageDial, d.ProxyAddr, addr, net.UnknownNetworkError(network))
+	}
+
+	if d.Bypass != nil && d.Bypass(addr) {
+		now := time.Now()
+		nd := d.netDialer(within(d.deadline(ctx, now), now, d.ConnectTimeout))
+		return nd.DialContext(ctx, network, addr)
+	}
+
+	dst, err := parseAddr(addr)
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, d.ProxyAddr, addr, err)
+	}
+	conn, err := d.dial(ctx, network, CommandConnect, dst)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial connects to the proxy and sends it a request for cmd to dst, moving on
+// to d.FallbackProxyAddrs as allowed by d.Retry.  The network is only used to
+// pick an address family when resolving host names locally.  The returned
+// connection records the address from the proxy's reply and the proxy which
+// sent it.  The outcome is reported to d.Metrics, and for CONNECT, the
+// returned connection counts the bytes passing through it.
+func (d *Dialer) dial(ctx context.Context, network string, cmd Command, dst *Addr) (*Conn, error) {
+	id, hop := ctx.Value(hopKey{}).(string)
+	if !hop {
+		id = dialID(ctx)
+		ContextClientTrace(ctx).dialStart(id, dst.String())
+		if d.Forward != nil {
+			ctx = context.WithValue(ctx, hopKey{}, id)
+		}
+	}
+	if d.Metrics == nil && !d.reportsThroughput() {
+		return d.dialHops(ctx, network, cmd, dst, id, nil)
+	}
+	start := time.Now()
+	stats := &DialStats{ID: id, Command: cmd, Target: dst, Proxy: d.ProxyAddr}
+	conn, err := d.dialHops(ctx, network, cmd, dst, id, stats)
+	stats.Duration = time.Since(start)
+	if d.Metrics != nil {
+		d.Metrics.DialDone(stats, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cmd == CommandConnect {
+		conn.counter = d.newConnCounter(stats)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) reportsThroughput() bool {
+	return d.ReportThroughput != nil && d.ThroughputInterval > 0
+}
+
+// newConnCounter returns the counter for a connection the Dialer returns.
+func (d *Dialer) newConnCounter(stats *DialStats) *connCounter {
+	c := &connCounter{metrics: d.Metrics, stats: stats}
+	if d.reportsThroughput() {
+		c.reportThroughput(d.ThroughputInterval, d.ReportThroughput)
+	}
+	return c
+}
+
+// dialHops does the work of dial, for the dial with the given ID, trying each
+// address of the target in turn if it was resolved locally.  If stats is not
+// nil, the proxy and the duration of the handshake of each attempt are
+// recorded in it.
+func (d *Dialer) dialHops(ctx context.Context, network string, cmd Command, dst *Addr, id string, stats *DialStats) (*Conn, error) {
+	target, addr := dst, dst.String()
+	dst, err := d.asciiTarget(dst)
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, d.ProxyAddr, addr, err).withID(id)
+	}
+	deadline := d.deadline(ctx, time.Now())
+	dsts := []*Addr{dst}
+	if cmd != CommandResolve {
+		dsts, err = d.resolveTarget(ctx, deadline, network, dst)
+		if err != nil {
+			return nil, newHandshakeError(StageDial, d.ProxyAddr, addr, err).withID(id)
+		}
+	}
+
+	for i := 0; ; i++ {
+		conn, err := d.dialProxies(ctx, deadline, cmd, dsts[i], addr, id, stats)
+		if err == nil {
+			conn.target, conn.id = target, id
+			return conn, nil
+		}
+		// a reply code means the proxy was fine, but could not or would
+		// not reach this address
+		if i == len(dsts)-1 || err.ReplyCode == ReplySucceeded || expired(ctx, deadline) {
+			return nil, err
+		}
+	}
+}
+
+// dialProxies tries to have dst reached through d.ProxyAddr, and then
+// d.FallbackProxyAddrs as allowed by d.Retry.
+func (d *Dialer) dialProxies(ctx context.Context, deadline time.Time, cmd Command, dst *Addr, addr, id string, stats *DialStats) (*Conn, *HandshakeError) {
+	hop := d
+	for i := 0; ; i++ {
+		conn, err := hop.dialOnce(ctx, deadline, cmd, dst, addr, stats)
+		if err == nil {
+			return conn, nil
+		}
+		err.ID = id
+		if i == len(d.FallbackProxyAddrs) || !d.retry(ctx, deadline, err) {
+			return nil, err
+		}
+		next := *d
+		next.ProxyAddr = d.FallbackProxyAddrs[i]
+		hop = &next
+	}
+}
+
+// dialOnce makes a single attempt at dial through d.ProxyAddr.
+func (d *Dialer) dialOnce(ctx context.Context, deadline time.Time, cmd Command, dst *Addr, addr string, stats *DialStats) (*Conn, *HandshakeError) {
+	if stats != nil {
+		stats.Proxy, stats.HandshakeDuration = d.ProxyAddr, 0
+	}
+	trace := ContextClientTrace(ctx)
+	trace.connectStart(d.ProxyAddr)
+	conn, err := d.dialProxy(ctx, within(deadline, time.Now(), d.ConnectTimeout))
+	if err != nil {
+		trace.connectDone(d.ProxyAddr, err)
+		return nil, newHandshakeError(StageDial, d.ProxyAddr, addr, err)
+	}
+	hsStart := time.Now()
+	hsDeadline := within(deadline, hsStart, d.HandshakeTimeout)
+	if d.TLSConfig != nil {
+		conn, err = d.tlsClient(ctx, hsDeadline, conn)
+		if err != nil {
+			if stats != nil {
+				stats.HandshakeDuration = time.Since(hsStart)
+			}
+			trace.connectDone(d.ProxyAddr, err)
+			return nil, newHandshakeError(StageDial, d.ProxyAddr, addr, err)
+		}
+	}
+	trace.connectDone(d.ProxyAddr, nil)
+	hsConn, bound, herr := d.handshake(ctx, conn, hsDeadline, cmd, dst, d.ProxyAddr, addr)
+	if stats != nil {
+		stats.HandshakeDuration = time.Since(hsStart)
+	}
+	if herr != nil {
+		conn.Close()
+		if d.Version == VersionAuto && socks5Unsupported(herr) {
+			dd := *d
+			dd.Version = VersionSocks4a
+			return dd.dialOnce(ctx, deadline, cmd, dst, addr, stats)
+		}
+		return nil, herr
+	}
+	return &Conn{
+		Conn:		hsConn,
+		boundAddr:	bound,
+		proxy:		d.ProxyAddr,
+		socks4:		d.socks4(),
+	}, nil
+}
+
+// retry says whether to move on to the next proxy after err.  There is no
+// point in doing so once ctx is done or the deadline has passed.
+func (d *Dialer) retry(ctx context.Context, deadline time.Time, err *HandshakeError) bool {
+	if expired(ctx, deadline) {
+		return false
+	}
+	if d.Retry != nil {
+		return d.Retry(err)
+	}
+	return err.Transient()
+}
+
+// expired reports whether ctx is done or the deadline has passed, so that
+// there is no time left for another attempt.
+func expired(ctx context.Context, deadline time.Time) bool {
+	return ctx.Err() != nil || (!deadline.IsZero() && !time.Now().Before(deadline))
+}
+
+// dialProxy opens the connection to the proxy, through d.Forward if set.
+func (d *Dialer) dialProxy(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	if d.Forward == nil {
+		nd := d.netDialer(deadline)
+		return nd.DialContext(ctx, "tcp", d.ProxyAddr)
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return d.Forward.DialContext(ctx, "tcp", d.ProxyAddr)
+}
+
+// tlsClient performs a TLS handshake with the proxy over conn.  conn is
+// closed if the handshake fails.
+func (d *Dialer) tlsClient(ctx context.Context, deadline time.Time, conn net.Conn) (net.Conn, error) {
+	config := d.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(d.ProxyAddr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Chain returns a Dialer which connects to targets through all of hops, in
+// order: the first hop is connected to directly, each subsequent hop is
+// reached through a tunnel established by the previous one, and the last hop
+// connects to the target.  Each hop performs its own negotiation and
+// authentication.  The hops are copied, and their Forward fields, except for
+// the first one's, are replaced; the returned Dialer's other fields are those
+// of the last hop.  All hops report to the ClientTrace of a dial under the
+// dial ID of the whole dial.  Chain panics if hops is empty.
+func Chain(hops ...*Dialer) *Dialer {
+	d := new(Dialer)
+	*d = *hops[0]
+	for _, hop := range hops[1:] {
+		next := new(Dialer)
+		*next = *hop
+		next.Forward = d
+		d = next
+	}
+	return d
+}
+
+// Client performs the SOCKS handshake on conn, an already established
+// connection to a proxy, and asks the proxy to connect to targetAddr.  This is
+// useful when the transport to the proxy is set up by other means, such as
+// through a jump host.  d.ProxyAddr, d.TLSConfig, d.Forward, d.NetDialer,
+// d.FallbackProxyAddrs and d.Bypass are not used.  On success, the returned
+// connection is a *Conn wrapping conn.  On failure, conn is left open, but is
+// no longer usable for SOCKS; any error returned is a *HandshakeError.
+func (d *Dialer) Client(ctx context.Context, conn net.Conn, targetAddr string) (net.Conn, error) {
+	proxy := conn.RemoteAddr().String()
+	dst, err := parseAddr(targetAddr)
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, proxy, targetAddr, err)
+	}
+	id := dialID(ctx)
+	ContextClientTrace(ctx).dialStart(id, targetAddr)
+	start := time.Now()
+	c, herr := d.client(ctx, conn, dst, proxy, targetAddr)
+	var stats *DialStats
+	if d.Metrics != nil || d.reportsThroughput() {
+		// there is no connecting to the proxy to leave out
+		elapsed := time.Since(start)
+		stats = &DialStats{
+			ID:					id,
+			Command:			CommandConnect,
+			Target:				dst,
+			Proxy:				proxy,
+			Duration:			elapsed,
+			HandshakeDuration:	elapsed,
+		}
+	}
+	if herr != nil {
+		herr.ID = id
+		if d.Metrics != nil {
+			d.Metrics.DialDone(stats, herr)
+		}
+		return nil, herr
+	}
+	c.id = id
+	if stats != nil {
+		if d.Metrics != nil {
+			d.Metrics.DialDone(stats, nil)
+		}
+		c.counter = d.newConnCounter(stats)
+	}
+	return c, nil
+}
+
+// client does the work of Client, for the target dst.
+func (d *Dialer) client(ctx context.Context, conn net.Conn, dst *Addr, proxy, targetAddr string) (*Conn, *HandshakeError) {
+	target := dst
+	dst, err := d.asciiTarget(dst)
+	if err != nil {
+		return nil, newHandshakeError(StageConnect, proxy, targetAddr, err)
+	}
+	deadline := d.deadline(ctx, time.Now())
+	dsts, err := d.resolveTarget(ctx, deadline, "tcp", dst)
+	if err != nil {
+		return nil, newHandshakeError(StageDial, proxy, targetAddr, err)
+	}
+	dst = dsts[0]
+	deadline = within(deadline, time.Now(), d.HandshakeTimeout)
+	hsConn, bound, herr := d.handshake(ctx, conn, deadline, CommandConnect, dst, proxy, targetAddr)
+	if herr != nil {
+		return nil, herr
+	}
+	return &Conn{Conn: hsConn, boundAddr: bound, proxy: proxy, target: target}, nil
+}
+
+// Client performs the SOCKS handshake on conn, an already established
+// connection to a proxy, and asks the proxy to connect to targetAddr.  The
+// given authentication methods are offered to the proxy, or NoAuthentication
+// if there are none.  See Dialer.Client for the details.
+func Client(conn net.Conn, targetAddr string, methods ...AuthMethod) (net.Conn, error) {
+	d := &Dialer{AuthMethods: methods}
+	return d.Client(context.Background(), conn, targetAddr)
+}
+
+// handshake runs the SOCKS handshake for cmd to dst on conn, within deadline
+// and for as long as ctx is not done.  Afterwards, the deadline of the
+// returned connection is set according to d.ConnTimeout.  Progress is
+// reported to the ClientTrace in ctx, if any.  proxy and addr are only used
+// for error reporting.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, deadline time.Time, cmd Command, dst *Addr, proxy, addr string) (net.Conn, *Addr, *HandshakeError) {
+	if !deadline.IsZero() {
+		err := conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, nil, newHandshakeError(StageDial, proxy, addr, err)
+		}
+	}
+
+	var hsConn net.Conn
+	var bound *Addr
+	var stage Stage
+	var err error
+	trace := ContextClientTrace(ctx)
+	tc, untrace := trace.traceRaw(conn)
+	stop := watchContext(ctx, conn)
+	if d.socks4() {
+		hsConn, stage = tc, StageConnect
+		bound, err = socks4Handshake(tc, cmd, dst, d.socks4UserID(), d.Version == VersionSocks4a)
+	} else {
+		hsConn, bound, stage, err = socks5Handshake(tc, cmd, dst, d.authMethods(), d.Pipeline, d.PrepareRequest, trace)
+	}
+	hsConn = untrace(hsConn)
+	if ctxErr := stop(); ctxErr != nil {
+		// the connection's deadline has been clobbered even if the
+		// handshake managed to complete
+		err = ctxErr
+	}
+	if err != nil {
+		return nil, nil, newHandshakeError(stage, proxy, addr, err)
+	}
+
+	if !deadline.IsZero() || d.ConnTimeout > 0 {
+		var connDeadline time.Time
+		if d.ConnTimeout > 0 {
+			connDeadline = time.Now().Add(d.ConnTimeout)
+		}
+		err = hsConn.SetDeadline(connDeadline)
+		if err != nil {
+			return nil, nil, newHandshakeError(stage, proxy, addr, err)
+		}
+	}
+	return hsConn, bound, nil
+}
+
+// netDialer returns a copy of d.NetDialer, or of the zero net.Dialer, whose
+// deadline is no later than deadline, and with d.KeepAlive and d.FallbackDelay
+// applied.
+func (d *Dialer) netDialer(deadline time.Time) net.Dialer {
+	var nd net.Dialer
+	if d.NetDialer != nil {
+		nd = *d.NetDialer
+	}
+	if d.KeepAlive != 0 {
+		nd.KeepAlive = d.KeepAlive
+	}
+	if d.FallbackDelay != 0 {
+		nd.FallbackDelay = d.FallbackDelay
+	}
+	if !deadline.IsZero() && (nd.Deadline.IsZero() || deadline.Before(nd.Deadline)) {
+		nd.Deadline = deadline
+	}
+	return nd
+}
+
+// socks4 reports whether d speaks SOCKS4 or SOCKS4a to the proxy.
+func (d *Dialer) socks4() bool {
+	return d.Version == VersionSocks4 || d.Version == VersionSocks4a
+}
+
+// socks4UserID returns the user ID to send in SOCKS4 requests.
+func (d *Dialer) socks4UserID() string {
+	if d.Auth != nil {
+		return d.Auth.User
+	}
+	return ""
+}
+
+// authMethods returns the authentication methods to offer to the proxy.
+func (d *Dialer) authMethods() []AuthMethod {
+	if d.AuthMethods != nil {
+		return d.AuthMethods
+	}
+	if d.Auth != nil {
+		return []AuthMethod{NoAuthentication, d.Auth}
+	}
+	return defaultAuthMethods
+}
+
+var defaultAuthMethods = []AuthMethod{NoAuthentication}
+
+// asciiTarget returns dst with its host name converted to ASCII, unless
+// d.DisableIDNA is set.  The original dst is left alone, so that it can still
+// be reported as the target.
+func (d *Dialer) asciiTarget(dst *Addr) (*Addr, error) {
+	if d.DisableIDNA {
+		return dst, nil
+	}
+	return asciiAddr(dst)
+}
+
+// asciiAddr returns dst, or a copy of it if its host name has to be converted
+// to ASCII.
+func asciiAddr(dst *Addr) (*Addr, error) {
+	if dst.Name == "" {
+		return dst, nil
+	}
+	name, err := toASCII(dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	if name == dst.Name {
+		return dst, nil
+	}
+	return &Addr{Name: name, Port: dst.Port}, nil
+}
+
+// resolveTarget looks up the host name in dst if d.Resolve is ResolveLocal, or
+// if SOCKS4 is used, and returns addresses with each of the IP addresses
+// found, in order.  Otherwise, dst is returned as is.
+func (d *Dialer) resolveTarget(ctx context.Context, deadline time.Time, network string, dst *Addr) ([]*Addr, error) {
+	if (d.Resolve != ResolveLocal && d.Version != VersionSocks4) || dst.IP != nil {
+		return []*Addr{dst}, nil
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	ipNetwork := "ip"
+	switch network[len(network)-1] {
+		case '4':
+			ipNetwork = "ip4"
+		case '6':
+			ipNetwork = "ip6"
+	}
+	if d.Version == VersionSocks4 {
+		ipNetwork = "ip4"
+	}
+
+	var r Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		r = d.Resolver
+	}
+	ips, err := r.LookupIP(ctx, ipNetwork, dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: dst.Name}
+	}
+	dsts := make([]*Addr, len(ips))
+	for i, ip := range ips {
+		dsts[i] = &Addr{IP: ip, Port: dst.Port}
+	}
+	return dsts, nil
+}
+
+// deadline returns the earliest of now+d.Timeout, d.Deadline and the context's
+// deadline, or the zero time if none of them applies.
+func (d *Dialer) deadline(ctx context.Context, now time.Time) time.Time {
+	deadline := within(d.Deadline, now, d.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// within returns the earlier of deadline and now+timeout.  A zero deadline or
+// a timeout which is not positive means no limit.
+func within(deadline, now time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return deadline
+	}
+	if t := now.Add(timeout); deadline.IsZero() || t.Before(deadline) {
+		return t
+	}
+	return deadline
+}
+
+// aLongTimeAgo is a deadline in the past, used to unblock pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext arranges for any I/O on conn to be interrupted as soon as ctx
+// is done.  The returned function must be called once the caller is done with
+// the I/O; it returns the context's error if the context interrupted conn, and
+// nil otherwise.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+			case <-ctx.Done():
+				conn.SetDeadline(aLongTimeAgo)
+				result <- ctx.Err()
+			case <-done:
+				result <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
@@ -0,0 +1,376 @@
+package socks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPrepareRequest(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	echoPort, _ := strconv.Atoi(port)
+
+	d := &Dialer{
+		ProxyAddr:	startServer(t, &Server{}),
+		Timeout:	5 * time.Second,
+		PrepareRequest: func(req *Request) ([]byte, error) {
+			// redirect to the echo server, which sends the trailer back
+			req.Dst = &Addr{IP: net.IPv4(127, 0, 0, 1), Port: echoPort}
+			return []byte("ext"), nil
+		},
+	}
+	conn, err := d.Dial("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, 3)
+	_, err = io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ext" {
+		t.Errorf("got %q back, want the trailer \"ext\"", got)
+	}
+	if got := conn.RemoteAddr().String(); got != "127.0.0.1:1" {
+		t.Errorf("RemoteAddr() = %s, want the target as given", got)
+	}
+
+	errHook := errors.New("no such extension")
+	d.PrepareRequest = func(req *Request) ([]byte, error) {
+		return nil, errHook
+	}
+	_, err = d.Dial("tcp", echo)
+	if !errors.Is(err, errHook) {
+		t.Errorf("got %v, want the error returned by PrepareRequest", err)
+	}
+}
+
+func TestResolveLocal(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	var got *Addr
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			got = dst
+			return true
+		}),
+	}
+	d := &Dialer{
+		ProxyAddr:	startServer(t, s),
+		Timeout:	5 * time.Second,
+		Resolve:	ResolveLocal,
+		Resolver:	staticResolver{"echo.test": {net.IPv4(127, 0, 0, 1)}},
+	}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+	if got == nil || got.Name != "" || !got.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("proxy got a request for %v, want 127.0.0.1", got)
+	}
+	if want := net.JoinHostPort("echo.test", port); conn.RemoteAddr().String() != want {
+		t.Errorf("RemoteAddr() = %s, want %s", conn.RemoteAddr(), want)
+	}
+
+	_, err = d.Dial("tcp", "unknown.test:80")
+	var dnsErr *net.DNSError
+	var herr *HandshakeError
+	if !errors.As(err, &dnsErr) || !errors.As(err, &herr) || herr.Stage != StageDial {
+		t.Errorf("got %v, want a DNS error at the dial stage", err)
+	}
+}
+
+func TestResolveLocalFallback(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	var tried []string
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			tried = append(tried, dst.IP.String())
+			return true
+		}),
+	}
+	d := &Dialer{
+		ProxyAddr:	startServer(t, s),
+		Timeout:	5 * time.Second,
+		Resolve:	ResolveLocal,
+		// the echo server only listens on 127.0.0.1, so the proxy is
+		// refused on 127.0.0.2
+		Resolver:	staticResolver{
+			"echo.test":	{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)},
+			"gone.test":	{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)},
+		},
+	}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+	if len(tried) != 2 || tried[0] != "127.0.0.2" || tried[1] != "127.0.0.1" {
+		t.Errorf("proxy was asked for %v, want [127.0.0.2 127.0.0.1]", tried)
+	}
+
+	tried = nil
+	_, err = d.Dial("tcp", net.JoinHostPort("gone.test", port))
+	if !errors.Is(err, ReplyConnectionRefused) {
+		t.Errorf("got %v, want ReplyConnectionRefused", err)
+	}
+	if len(tried) != 2 {
+		t.Errorf("proxy was asked for %v, want both addresses", tried)
+	}
+}
+
+func TestReportThroughput(t *testing.T) {
+	reports := make(chan Throughput, 100)
+	d := &Dialer{
+		ProxyAddr:			startServer(t, &Server{}),
+		Timeout:			5 * time.Second,
+		ThroughputInterval:	10 * time.Millisecond,
+		ReportThroughput: func(stats *DialStats, tp Throughput) {
+			reports <- tp
+		},
+	}
+	conn, err := d.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		var tp Throughput
+		select {
+			case tp = <-reports:
+			case <-timeout:
+				t.Fatal("no report of the echoed bytes")
+		}
+		if tp.Read == 12 && tp.Written == 12 && tp.Elapsed > 0 {
+			break
+		}
+	}
+	conn.Close()
+	// a report may have been in progress during Close, but none starts after
+	time.Sleep(20 * time.Millisecond)
+	for len(reports) > 0 {
+		<-reports
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(reports); n != 0 {
+		t.Errorf("got %d reports after Close", n)
+	}
+}
+
+func TestFallbackAfterConnectTimeout(t *testing.T) {
+	stalled := "stalled.invalid:1080"
+	good := startServer(t, &Server{})
+	d := &Dialer{
+		ProxyAddr:			stalled,
+		FallbackProxyAddrs:	[]string{good},
+		Timeout:			5 * time.Second,
+		ConnectTimeout:		50 * time.Millisecond,
+		// the first proxy never answers the connection attempt
+		Forward: dialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == stalled {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, addr)
+		}),
+	}
+	var herrs []*HandshakeError
+	d.Retry = func(err *HandshakeError) bool {
+		herrs = append(herrs, err)
+		return err.Transient()
+	}
+	conn, err := d.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatalf("got %v, want the fallback proxy to be used", err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+	if got := conn.(*Conn).Proxy(); got != good {
+		t.Errorf("Proxy() = %s, want %s", got, good)
+	}
+	if len(herrs) != 1 || herrs[0].Stage != StageDial || !errors.Is(herrs[0], context.DeadlineExceeded) {
+		t.Errorf("Retry saw %v, want a connect timeout", herrs)
+	}
+
+	// once the caller's own deadline has passed, no fallback is tried
+	herrs = nil
+	d.ConnectTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = d.DialContext(ctx, "tcp", startEcho(t))
+	if !errors.Is(err, context.DeadlineExceeded) || len(herrs) != 0 {
+		t.Errorf("got %v after asking Retry %d times, want the deadline and no retries", err, len(herrs))
+	}
+}
+
+// selfSigned returns a TLS certificate for the given host names, and a pool
+// trusting it.
+func selfSigned(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:	big.NewInt(1),
+		DNSNames:		names,
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+	echo := startEcho(t)
+	cert, pool := selfSigned(t, "localhost", "proxy.test")
+	sni := make(chan string, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	go s.Serve(tls.NewListener(l, &tls.Config{
+		Certificates:	[]tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}))
+	t.Cleanup(func() { s.Close() })
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// the host part of ProxyAddr is used for SNI and verification, without
+	// changing TLSConfig
+	config := &tls.Config{RootCAs: pool}
+	d := &Dialer{
+		ProxyAddr:	net.JoinHostPort("localhost", port),
+		Timeout:	5 * time.Second,
+		TLSConfig:	config,
+	}
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if got := <-sni; got != "localhost" {
+		t.Errorf("proxy got SNI %q, want localhost", got)
+	}
+	if config.ServerName != "" {
+		t.Errorf("TLSConfig.ServerName set to %q", config.ServerName)
+	}
+
+	// an explicit ServerName takes precedence
+	d.ProxyAddr = l.Addr().String()
+	d.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "proxy.test"}
+	conn, err = d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if got := <-sni; got != "proxy.test" {
+		t.Errorf("proxy got SNI %q, want proxy.test", got)
+	}
+
+	// a certificate which is not valid for ProxyAddr fails the dial
+	d.TLSConfig = &tls.Config{RootCAs: pool}
+	_, err = d.Dial("tcp", echo)
+	<-sni
+	var herr *HandshakeError
+	var certErr x509.HostnameError
+	if !errors.As(err, &herr) || herr.Stage != StageDial || !errors.As(err, &certErr) {
+		t.Errorf("dial to 127.0.0.1: got %v, want a certificate error at the dial stage", err)
+	}
+
+	// the TLS handshake is bounded by HandshakeTimeout
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	d.ProxyAddr = stalled.Addr().String()
+	d.HandshakeTimeout = 50 * time.Millisecond
+	_, err = d.Dial("tcp", echo)
+	if !errors.As(err, &herr) || herr.Stage != StageDial || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stalled TLS handshake: got %v, want a timeout at the dial stage", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	echo := startEcho(t)
+	client, server := net.Pipe()
+	go (&Server{}).ServeConn(server)
+	defer client.Close()
+	conn, err := Client(client, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	c := conn.(*Conn)
+	if c.RemoteAddr().String() != echo || c.Proxy() != "pipe" {
+		t.Errorf("got RemoteAddr() %s and Proxy() %s, want %s via pipe", c.RemoteAddr(), c.Proxy(), echo)
+	}
+
+	// a refused request leaves the connection open for the caller
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		var g Greeting
+		if _, err := g.ReadFrom(server); err != nil {
+			return
+		}
+		server.Write([]byte{socks5Version, 0x00})
+		var req Request
+		if _, err := req.ReadFrom(server); err != nil {
+			return
+		}
+		b, _ := (&Reply{Code: ReplyNotAllowed, Bound: &Addr{IP: net.IPv4zero}}).Marshal()
+		server.Write(b)
+		io.Copy(server, server)
+	}()
+	d := &Dialer{AuthMethods: []AuthMethod{NoAuthentication}}
+	_, err = d.Client(context.Background(), client, echo)
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.Stage != StageConnect || !errors.Is(err, ReplyNotAllowed) {
+		t.Fatalf("got %v, want ReplyNotAllowed at the connect stage", err)
+	}
+	if herr.ID == "" || herr.Proxy != "pipe" || herr.Target != echo {
+		t.Errorf("got error %#v, want its dial ID, proxy and target set", herr)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, client)
+
+	_, err = d.Client(context.Background(), client, "no port")
+	if !errors.As(err, &herr) || herr.Stage != StageConnect {
+		t.Errorf("invalid target: got %v, want a connect stage error", err)
+	}
+}
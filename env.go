@@ -0,0 +1,107 @@
+package socks
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// FromEnvironment returns a Dialer configured from the environment, following
+// the conventions of curl and similar tools.  The proxy is taken from
+// ALL_PROXY (or all_proxy), which must be a URL accepted by FromURL.  Targets
+// matching NO_PROXY (or no_proxy) are dialed directly; see Dialer.Bypass.  If
+// ALL_PROXY is not set, the returned Dialer dials every target directly.
+//
+// NO_PROXY is a comma-separated list of host names, which also match their
+// subdomains, IP addresses and CIDR blocks, each optionally followed by a
+// port.  A single "*" matches every target.
+func FromEnvironment() (*Dialer, error) {
+	proxy := getenv("ALL_PROXY", "all_proxy")
+	if proxy == "" {
+		return &Dialer{Bypass: func(string) bool { return true }}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	d, err := FromURL(u)
+	if err != nil {
+		return nil, err
+	}
+	if noProxy := getenv("NO_PROXY", "no_proxy"); noProxy != "" {
+		d.Bypass = noProxyMatcher(noProxy)
+	}
+	return d, nil
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// noProxyMatcher returns a function reporting whether an address matches one
+// of the entries in noProxy.
+func noProxyMatcher(noProxy string) func(addr string) bool {
+	type entry struct {
+		domain	string
+		ip		net.IP
+		network	*net.IPNet
+		port	string
+	}
+	var entries []entry
+	for _, field := range strings.Split(noProxy, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		if field == "*" {
+			return func(string) bool { return true }
+		}
+		if _, network, err := net.ParseCIDR(field); err == nil {
+			entries = append(entries, entry{network: network})
+			continue
+		}
+		var e entry
+		if host, port, err := net.SplitHostPort(field); err == nil {
+			field, e.port = host, port
+		} else if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+			field = field[1:len(field)-1]
+		}
+		if ip := net.ParseIP(field); ip != nil {
+			e.ip = ip
+		} else {
+			e.domain = strings.TrimPrefix(strings.TrimPrefix(field, "*"), ".")
+		}
+		entries = append(entries, e)
+	}
+
+	return func(addr string) bool {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		host = strings.ToLower(host)
+		ip := net.ParseIP(host)
+		for _, e := range entries {
+			switch {
+				case e.network != nil:
+					if ip != nil && e.network.Contains(ip) {
+						return true
+					}
+				case e.port != "" && e.port != port:
+				case e.ip != nil:
+					if e.ip.Equal(ip) {
+						return true
+					}
+				case host == e.domain || strings.HasSuffix(host, "."+e.domain):
+					return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+package socks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNoProxyMatcher(t *testing.T) {
+	tests := []struct {
+		noProxy	string
+		addr	string
+		want	bool
+	}{
+		// host names match themselves and their subdomains
+		{"example.com", "example.com:80", true},
+		{"example.com", "WWW.Example.COM:443", true},
+		{"example.com", "badexample.com:80", false},
+		{"example.com", "example.com.evil:80", false},
+		{".example.com", "example.com:80", true},
+		{".example.com", "a.b.example.com:80", true},
+		{"*.example.com", "example.com:80", true},
+		{"*.example.com", "www.example.com:80", true},
+		{"*.example.com", "example.org:80", false},
+		{"EXAMPLE.com", "example.com:80", true},
+
+		// an entry with a port only matches that port
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8080", "example.com:80", false},
+		{"10.0.0.1:22", "10.0.0.1:22", true},
+		{"10.0.0.1:22", "10.0.0.1:80", false},
+
+		// IP addresses are compared as such
+		{"10.0.0.1", "10.0.0.1:80", true},
+		{"10.0.0.1", "10.0.0.2:80", false},
+		{"::1", "[::1]:80", true},
+		{"::1", "[0:0::1]:80", true},
+		{"[::1]", "[::1]:80", true},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", true},
+		{"[2001:db8::1]:443", "[2001:db8::1]:80", false},
+		{"10.0.0.1", "host.example:80", false},
+
+		// CIDR blocks match the addresses in them, on any port
+		{"192.168.0.0/16", "192.168.33.7:80", true},
+		{"192.168.0.0/16", "192.169.0.1:80", false},
+		{"2001:db8::/32", "[2001:db8:1::5]:443", true},
+		{"192.168.0.0/16", "192.168.host.example:80", false},
+
+		// lists, spaces and the wildcard
+		{"foo.test, bar.test", "bar.test:80", true},
+		{"foo.test,,bar.test", "baz.test:80", false},
+		{"*", "anything.example:1", true},
+		{"foo.test,*", "anything.example:1", true},
+		{"", "example.com:80", false},
+
+		// addresses without a port never match
+		{"example.com", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := noProxyMatcher(tt.noProxy)(tt.addr); got != tt.want {
+			t.Errorf("NO_PROXY=%q, %s: got %v, want %v", tt.noProxy, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+
+	// without a proxy, everything is dialed directly
+	d, err := FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Bypass == nil || !d.Bypass("example.com:80") {
+		t.Error("without ALL_PROXY, targets are not bypassed")
+	}
+
+	t.Setenv("all_proxy", "socks5h://proxy.example")
+	t.Setenv("no_proxy", ".internal, 10.0.0.0/8")
+	d, err = FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ProxyAddr != "proxy.example:1080" || d.Resolve != ResolveRemote {
+		t.Errorf("got ProxyAddr %s and Resolve %v from all_proxy", d.ProxyAddr, d.Resolve)
+	}
+	if d.Bypass == nil || !d.Bypass("db.internal:5432") || !d.Bypass("10.1.2.3:80") || d.Bypass("example.com:80") {
+		t.Error("no_proxy not applied")
+	}
+
+	// the upper case names take precedence
+	t.Setenv("ALL_PROXY", "socks4a://other.example:9050")
+	t.Setenv("NO_PROXY", "example.com")
+	d, err = FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ProxyAddr != "other.example:9050" || d.Version != VersionSocks4a {
+		t.Errorf("got ProxyAddr %s and Version %v from ALL_PROXY", d.ProxyAddr, d.Version)
+	}
+	if !d.Bypass("example.com:80") || d.Bypass("db.internal:5432") {
+		t.Error("NO_PROXY not applied")
+	}
+
+	t.Setenv("ALL_PROXY", "http://proxy.example:3128")
+	_, err = FromEnvironment()
+	if !errors.Is(err, ErrURLScheme) {
+		t.Errorf("HTTP proxy: got %v, want %v", err, ErrURLScheme)
+	}
+	t.Setenv("ALL_PROXY", "socks5://[::1")
+	_, err = FromEnvironment()
+	if err == nil {
+		t.Error("malformed ALL_PROXY accepted")
+	}
+}
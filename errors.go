@@ -0,0 +1,212 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Errors returned by the Dial functions when the proxy misbehaves or refuses
+// the request, and by the message encoders and decoders.  Where the proxy sent
+// an unexpected byte, the returned error wraps one of these in a
+// *ProtocolError which reports the byte; use errors.Is to test for them.  When
+// the proxy refuses a request, the error wraps the ReplyCode it sent, which
+// also matches ErrRequestFailed.  If the connection ends in the middle of a
+// message, the error matches ErrShortMessage as well as io.ErrUnexpectedEOF;
+// if it ends before the proxy sent anything in answer, the error is io.EOF.
+var (
+	ErrNotSocks5			= errors.New("SOCKS proxy server does not support SOCKS5")
+	ErrVersion				= errors.New("SOCKS version is not 5")
+	ErrShortMessage			= errors.New("truncated SOCKS5 message")
+	ErrMethodNegotiation	= errors.New("SOCKS authentication method negotiation failed")
+	ErrAuthMethods			= errors.New("between 1 and 255 SOCKS authentication methods must be offered")
+	ErrHostnameTooLong		= errors.New("hostname over maximum length 255")
+	ErrInvalidHostname		= errors.New("invalid internationalized hostname")
+	ErrReplyVersion			= errors.New("SOCKS version in reply is not 5")
+	ErrRequestFailed		= errors.New("could not complete SOCKS5 connection")
+	ErrReservedByte			= errors.New("SOCKS5: reserved byte is not 0x00")
+	ErrAddrType				= errors.New("invalid address type in SOCKS5 message")
+	ErrInvalidAddr			= errors.New("SOCKS address needs a 4 or 16 byte IP address or a host name, and a port from 0 to 65535")
+	ErrInvalidCredentials	= errors.New("SOCKS username must be 1 to 255 bytes and password at most 255 bytes")
+	ErrAuthVersion			= errors.New("SOCKS username/password sub-negotiation version is not 1")
+	ErrAuthFailed			= errors.New("SOCKS username/password authentication failed")
+	ErrGSSAPIVersion		= errors.New("SOCKS GSS-API message version is not 1")
+	ErrGSSAPIMessageType	= errors.New("unexpected SOCKS GSS-API message type")
+	ErrGSSAPIAborted		= errors.New("SOCKS GSS-API authentication aborted by the proxy")
+	ErrGSSAPIProtection		= errors.New("SOCKS GSS-API protection level not acceptable")
+	ErrGSSAPITokenTooLong	= errors.New("SOCKS GSS-API token over maximum length 65535")
+	ErrSocks4Command		= errors.New("command not supported by SOCKS4")
+	ErrSocks4Addr			= errors.New("SOCKS4 target must be an IPv4 address, or a host name with SOCKS4a")
+	ErrSocks4ReplyVersion	= errors.New("SOCKS4 reply version is not 0")
+	ErrSocks4Rejected		= errors.New("SOCKS4 request rejected or failed")
+	ErrSocks4Ident			= errors.New("SOCKS4 request rejected because the proxy could not verify the user ID with identd")
+)
+
+// ProtocolError annotates one of the predeclared errors with the byte the
+// proxy actually sent, such as the version, method or address type.  It is
+// much cheaper to build than a fmt.Errorf value, which matters when a busy
+// program sees a lot of failed handshakes.
+type ProtocolError struct {
+	Err		error
+	Value	byte
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Err.Error() + ": " + strconv.FormatUint(uint64(e.Value), 16)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// errTruncated is returned when the connection ends in the middle of a
+// message.  It matches both ErrShortMessage and io.ErrUnexpectedEOF, which
+// tells it apart from the connection ending before a message, reported as
+// io.EOF: the latter is what a proxy which refuses to talk usually does,
+// whereas the former suggests a broken or hostile one.
+var errTruncated error = truncatedError{}
+
+type truncatedError struct{}
+
+func (truncatedError) Error() string {
+	return "truncated SOCKS message: unexpected EOF"
+}
+
+func (truncatedError) Is(target error) bool {
+	return target == ErrShortMessage || target == io.ErrUnexpectedEOF
+}
+
+// Stage identifies the step of connecting through the proxy at which a
+// failure occurred.
+type Stage int
+
+const (
+	StageDial				Stage = iota	// connecting to the proxy
+	StageMethodNegotiation					// greeting and method selection
+	StageAuth								// authentication sub-negotiation
+	StageConnect							// request (usually CONNECT) and reply
+)
+
+func (s Stage) String() string {
+	switch s {
+		case StageDial:
+			return "dial"
+		case StageMethodNegotiation:
+			return "method negotiation"
+		case StageAuth:
+			return "authentication"
+		case StageConnect:
+			return "connect"
+	}
+	return "stage " + strconv.Itoa(int(s))
+}
+
+// ReplyCode is the REP field of a SOCKS5 reply.  A ReplyCode other than
+// ReplySucceeded is also an error, so the reply codes can be used with
+// errors.Is; they all match ErrRequestFailed as well.
+type ReplyCode byte
+
+// Reply codes defined by RFC 1928.
+const (
+	ReplySucceeded				ReplyCode = 0x00
+	ReplyGeneralFailure			ReplyCode = 0x01
+	ReplyNotAllowed				ReplyCode = 0x02
+	ReplyNetworkUnreachable		ReplyCode = 0x03
+	ReplyHostUnreachable		ReplyCode = 0x04
+	ReplyConnectionRefused		ReplyCode = 0x05
+	ReplyTTLExpired				ReplyCode = 0x06
+	ReplyCommandNotSupported	ReplyCode = 0x07
+	ReplyAddrTypeNotSupported	ReplyCode = 0x08
+)
+
+func (c ReplyCode) String() string {
+	switch c {
+		case ReplySucceeded:
+			return "succeeded"
+		case ReplyGeneralFailure:
+			return "general SOCKS server failure"
+		case ReplyNotAllowed:
+			return "connection not allowed by ruleset"
+		case ReplyNetworkUnreachable:
+			return "network unreachable"
+		case ReplyHostUnreachable:
+			return "host unreachable"
+		case ReplyConnectionRefused:
+			return "connection refused"
+		case ReplyTTLExpired:
+			return "TTL expired"
+		case ReplyCommandNotSupported:
+			return "command not supported"
+		case ReplyAddrTypeNotSupported:
+			return "address type not supported"
+	}
+	return "unknown reply code " + strconv.FormatUint(uint64(c), 16)
+}
+
+func (c ReplyCode) Error() string {
+	return ErrRequestFailed.Error() + ": " + c.String()
+}
+
+// Is reports whether target is ErrRequestFailed.
+func (c ReplyCode) Is(target error) bool {
+	return target == ErrRequestFailed
+}
+
+// HandshakeError is the type of all errors returned by the Dial functions.  It
+// records how far the attempt got before it failed.
+type HandshakeError struct {
+	Stage	Stage
+	Proxy	string	// proxy address as given by the caller
+	Target	string	// target address as given by the caller
+
+	// ID is the dial ID (see WithDialID) of the dial which failed.  It is
+	// empty if the failure was detected before the dial started, such as
+	// for a malformed target address.
+	ID		string
+
+	// ReplyCode is the REP field sent by the proxy when it refused the
+	// request, and ReplySucceeded otherwise.
+	ReplyCode	ReplyCode
+
+	Err		error
+}
+
+func newHandshakeError(stage Stage, proxy, target string, err error) *HandshakeError {
+	e := &HandshakeError{Stage: stage, Proxy: proxy, Target: target, Err: err}
+	if code, ok := err.(ReplyCode); ok {
+		e.ReplyCode = code
+	}
+	return e
+}
+
+// withID sets e.ID, and returns e.
+func (e *HandshakeError) withID(id string) *HandshakeError {
+	e.ID = id
+	return e
+}
+
+func (e *HandshakeError) Error() string {
+	s := "SOCKS " + e.Stage.String() + " failed for " + e.Target + " via " + e.Proxy
+	if e.ID != "" {
+		s += " (dial " + e.ID + ")"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Transient reports whether the failure may well not recur through a
+// different proxy: the proxy could not be reached, or it refused the request
+// with ReplyGeneralFailure, ReplyNetworkUnreachable, ReplyHostUnreachable or
+// ReplyTTLExpired.  A proxy which could not be reached within
+// Dialer.ConnectTimeout counts as unreachable; whether the dial as a whole
+// has time left for another attempt is for the Dialer to check.
+func (e *HandshakeError) Transient() bool {
+	switch e.ReplyCode {
+		case ReplyGeneralFailure, ReplyNetworkUnreachable, ReplyHostUnreachable, ReplyTTLExpired:
+			return true
+	}
+	return e.Stage == StageDial
+}
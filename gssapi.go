@@ -0,0 +1,247 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// GSS-API message version and types
+const socks5GSSAPIVersion byte			= 0x01
+const socks5GSSAPIToken byte			= 0x01
+const socks5GSSAPIProtection byte		= 0x02
+const socks5GSSAPIEncapsulation byte	= 0x03
+const socks5GSSAPIAbort byte			= 0xFF
+
+// gssapiChunkLen is the largest amount of data wrapped into a single
+// encapsulated message.  The token length field is 16 bits, and this leaves
+// room for the mechanism's own overhead.
+const gssapiChunkLen = 0x8000
+
+// GSSAPIContext is a GSS-API security context, such as one established with a
+// Kerberos library.  This package only implements the SOCKS side of RFC 1961;
+// the mechanism is supplied by the caller through this interface.  Wrap and
+// Unwrap may be called concurrently once the context is established.
+type GSSAPIContext interface {
+	// InitSecContext corresponds to gss_init_sec_context.  It is first
+	// called with a nil input, and then with each token received from the
+	// proxy for as long as it reports that it needs to continue.  A
+	// non-empty output token is sent to the proxy.
+	InitSecContext(input []byte) (output []byte, continueNeeded bool, err error)
+
+	// Wrap corresponds to gss_wrap, with conf_req_flag set to confidential.
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+
+	// Unwrap corresponds to gss_unwrap.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSAPIProtection is a message protection level defined by RFC 1961.
+type GSSAPIProtection byte
+
+const (
+	GSSAPIIntegrity			GSSAPIProtection = 0x01	// per-message integrity
+	GSSAPIConfidentiality	GSSAPIProtection = 0x02	// per-message integrity and confidentiality
+	GSSAPISelective			GSSAPIProtection = 0x03	// selective per-message protection
+)
+
+// GSSAPI is the AuthMethod for GSS-API authentication, as described in RFC
+// 1961.  Once the security context is established and the protection level
+// agreed on, all traffic on the connection, including the SOCKS request, is
+// encapsulated according to that level.
+type GSSAPI struct {
+	// NewContext is called for each connection to the proxy, and returns a
+	// fresh security context for the proxy's service principal.
+	NewContext	func() (GSSAPIContext, error)
+
+	// Protection is the protection level asked for.  Asking for
+	// GSSAPIIntegrity lets the proxy choose any level, but asking for
+	// GSSAPIConfidentiality or GSSAPISelective requires the proxy to choose
+	// that same level: selective protection may leave some messages
+	// unencrypted, and is no stronger than confidentiality.  Otherwise
+	// Negotiate fails with ErrGSSAPIProtection.  Zero means
+	// GSSAPIConfidentiality.
+	Protection	GSSAPIProtection
+}
+
+// Method returns 0x01, the METHOD value of GSS-API authentication.
+func (g *GSSAPI) Method() byte {
+	return socks5GSSAPI
+}
+
+// Negotiate establishes the security context and the protection level with
+// the proxy over conn, and returns a connection which encapsulates traffic
+// sent over conn.
+func (g *GSSAPI) Negotiate(conn net.Conn) (net.Conn, error) {
+	ctx, err := g.NewContext()
+	if err != nil {
+		return nil, err
+	}
+
+	var input []byte
+	for {
+		output, continueNeeded, err := ctx.InitSecContext(input)
+		if err != nil {
+			return nil, err
+		}
+		if len(output) > 0 {
+			err = writeGSSAPIMessage(conn, socks5GSSAPIToken, output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !continueNeeded {
+			break
+		}
+		input, err = readGSSAPIMessage(conn, socks5GSSAPIToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	want := g.Protection
+	if want == 0 {
+		want = GSSAPIConfidentiality
+	}
+	// the protection level is sent with integrity protection only, as
+	// required by the RFC
+	token, err := ctx.Wrap([]byte{byte(want)}, false)
+	if err != nil {
+		return nil, err
+	}
+	err = writeGSSAPIMessage(conn, socks5GSSAPIProtection, token)
+	if err != nil {
+		return nil, err
+	}
+	token, err = readGSSAPIMessage(conn, socks5GSSAPIProtection)
+	if err != nil {
+		return nil, err
+	}
+	level, err := ctx.Unwrap(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(level) != 1 {
+		return nil, ErrGSSAPIProtection
+	}
+	got := GSSAPIProtection(level[0])
+	if !protectionAcceptable(want, got) {
+		return nil, &ProtocolError{ErrGSSAPIProtection, level[0]}
+	}
+	return &gssapiConn{
+		Conn:			conn,
+		ctx:			ctx,
+		confidential:	got != GSSAPIIntegrity,
+	}, nil
+}
+
+// protectionAcceptable reports whether the proxy's choice of protection level,
+// got, satisfies the level asked for, want.
+func protectionAcceptable(want, got GSSAPIProtection) bool {
+	switch want {
+		case GSSAPIIntegrity:
+			return got >= GSSAPIIntegrity && got <= GSSAPISelective
+		default:
+			return got == want
+	}
+}
+
+// gssapiConn encapsulates the data sent over a connection in GSS-API
+// encapsulation messages.
+type gssapiConn struct {
+	net.Conn
+	ctx				GSSAPIContext
+	confidential	bool
+
+	readMu	sync.Mutex
+	pending	[]byte	// unwrapped data not yet returned by Read
+
+	writeMu	sync.Mutex
+}
+
+func (c *gssapiConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		token, err := readGSSAPIMessage(c.Conn, socks5GSSAPIEncapsulation)
+		if err != nil {
+			return 0, err
+		}
+		c.pending, err = c.ctx.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var n int
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > gssapiChunkLen {
+			chunk = chunk[:gssapiChunkLen]
+		}
+		token, err := c.ctx.Wrap(chunk, c.confidential)
+		if err != nil {
+			return n, err
+		}
+		err = writeGSSAPIMessage(c.Conn, socks5GSSAPIEncapsulation, token)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// writeGSSAPIMessage sends a GSS-API message of type mtyp carrying token.
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xFFFF {
+		return ErrGSSAPITokenTooLong
+	}
+	msg := make([]byte, 0, 4+len(token))
+	msg = append(msg, socks5GSSAPIVersion, mtyp)
+	msg = append(msg, htons(uint16(len(token)))...)
+	msg = append(msg, token...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// readGSSAPIMessage reads a GSS-API message, which must be of type mtyp, and
+// returns its token.
+func readGSSAPIMessage(r io.Reader, mtyp byte) ([]byte, error) {
+	var hdr [4]byte
+	// an abort message has no length field, so it must be recognized
+	// before reading one
+	_, err := readFull(r, hdr[:2], false)
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5GSSAPIVersion {
+		return nil, &ProtocolError{ErrGSSAPIVersion, hdr[0]}
+	}
+	if hdr[1] == socks5GSSAPIAbort {
+		return nil, ErrGSSAPIAborted
+	}
+	if hdr[1] != mtyp {
+		return nil, &ProtocolError{ErrGSSAPIMessageType, hdr[1]}
+	}
+	_, err = readFull(r, hdr[2:], true)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = readFull(r, token, true)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,138 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeGSSAPIContext completes after one round trip, and wraps messages by
+// prefixing them with a byte which tells whether they are confidential.
+type fakeGSSAPIContext struct{}
+
+func (fakeGSSAPIContext) InitSecContext(input []byte) ([]byte, bool, error) {
+	if input == nil {
+		return []byte("client"), true, nil
+	}
+	if string(input) != "server" {
+		return nil, false, errors.New("unexpected token " + string(input))
+	}
+	return nil, false, nil
+}
+
+func (fakeGSSAPIContext) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	flag := byte('I')
+	if confidential {
+		flag = 'C'
+	}
+	return append([]byte{flag}, msg...), nil
+}
+
+func (fakeGSSAPIContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, errors.New("empty token")
+	}
+	return token[1:], nil
+}
+
+// negotiateGSSAPI runs g.Negotiate against peer, which is given the other end
+// of the connection.
+func negotiateGSSAPI(t *testing.T, g *GSSAPI, peer func(conn net.Conn)) (net.Conn, net.Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	go peer(server)
+	if g.NewContext == nil {
+		g.NewContext = func() (GSSAPIContext, error) {
+			return fakeGSSAPIContext{}, nil
+		}
+	}
+	conn, err := g.Negotiate(client)
+	return conn, server, err
+}
+
+func TestGSSAPIAbort(t *testing.T) {
+	// the abort message is two bytes long, and the proxy keeps the
+	// connection open after sending it
+	_, _, err := negotiateGSSAPI(t, &GSSAPI{}, func(conn net.Conn) {
+		readGSSAPIMessage(conn, socks5GSSAPIToken)
+		conn.Write([]byte{socks5GSSAPIVersion, socks5GSSAPIAbort})
+	})
+	if !errors.Is(err, ErrGSSAPIAborted) {
+		t.Fatalf("got %v, want %v", err, ErrGSSAPIAborted)
+	}
+}
+
+func TestGSSAPIProtection(t *testing.T) {
+	tests := []struct {
+		want, got		GSSAPIProtection
+		ok				bool
+		confidential	bool
+	}{
+		{0, GSSAPIConfidentiality, true, true},
+		{0, GSSAPIIntegrity, false, false},
+		{0, GSSAPISelective, false, false},
+		{GSSAPIIntegrity, GSSAPIIntegrity, true, false},
+		{GSSAPIIntegrity, GSSAPIConfidentiality, true, true},
+		{GSSAPIIntegrity, GSSAPISelective, true, true},
+		{GSSAPIIntegrity, 4, false, false},
+		{GSSAPIConfidentiality, GSSAPIConfidentiality, true, true},
+		{GSSAPIConfidentiality, GSSAPIIntegrity, false, false},
+		{GSSAPIConfidentiality, GSSAPISelective, false, false},
+		{GSSAPISelective, GSSAPISelective, true, true},
+		{GSSAPISelective, GSSAPIConfidentiality, false, false},
+	}
+	for _, tt := range tests {
+		asked := make(chan []byte, 1)
+		conn, server, err := negotiateGSSAPI(t, &GSSAPI{Protection: tt.want}, func(conn net.Conn) {
+			token, err := readGSSAPIMessage(conn, socks5GSSAPIToken)
+			if err != nil || string(token) != "client" {
+				return
+			}
+			writeGSSAPIMessage(conn, socks5GSSAPIToken, []byte("server"))
+			token, err = readGSSAPIMessage(conn, socks5GSSAPIProtection)
+			if err != nil {
+				return
+			}
+			asked <- token
+			writeGSSAPIMessage(conn, socks5GSSAPIProtection, []byte{'I', byte(tt.got)})
+		})
+		want := tt.want
+		if want == 0 {
+			want = GSSAPIConfidentiality
+		}
+		if token := <-asked; !bytes.Equal(token, []byte{'I', byte(want)}) {
+			t.Errorf("want %d: asked for %x", tt.want, token)
+		}
+		if !tt.ok {
+			if !errors.Is(err, ErrGSSAPIProtection) {
+				t.Errorf("want %d, got %d: err = %v, want %v", tt.want, tt.got, err, ErrGSSAPIProtection)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("want %d, got %d: %v", tt.want, tt.got, err)
+			continue
+		}
+
+		go conn.Write([]byte("hello"))
+		token, err := readGSSAPIMessage(server, socks5GSSAPIEncapsulation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantToken := "Ihello"
+		if tt.confidential {
+			wantToken = "Chello"
+		}
+		if string(token) != wantToken {
+			t.Errorf("want %d, got %d: encapsulated %q, want %q", tt.want, tt.got, token, wantToken)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package socks
+
+import (
+	"net/http"
+)
+
+// HTTPTransport returns an *http.Transport which makes all its connections
+// through d.  It starts out as a clone of http.DefaultTransport, but with
+// Proxy set to nil, so that HTTP proxies configured in the environment are not
+// used on top of d.  TLS for HTTPS targets is negotiated over the tunnel as
+// usual.  Dials carry the values of the request's context, such as a
+// ClientTrace or a dial ID, but recent versions of http.Transport let a dial
+// run on when its request is canceled, so that another request can use the
+// connection; set d.Timeout or d.HandshakeTimeout to bound them.
+func (d *Dialer) HTTPTransport() *http.Transport {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if ok {
+		t = t.Clone()
+	} else {
+		t = &http.Transport{}
+	}
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
@@ -0,0 +1,121 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello over "+r.Proto)
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var dsts []string
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			mu.Lock()
+			dsts = append(dsts, dst.String())
+			mu.Unlock()
+			return true
+		}),
+	}
+	d := &Dialer{ProxyAddr: startServer(t, s), Timeout: 5 * time.Second}
+	tr := d.HTTPTransport()
+	defer tr.CloseIdleConnections()
+	tr.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TLS == nil || string(body) != "hello over HTTP/1.1" {
+		t.Errorf("got %q (TLS %v), want a response over TLS", body, resp.TLS != nil)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := ts.Listener.Addr().String(); len(dsts) != 1 || dsts[0] != want {
+		t.Errorf("proxy got requests for %v, want [%s]", dsts, want)
+	}
+}
+
+func TestHTTPTransportCancel(t *testing.T) {
+	// a proxy which reads the greeting but never answers, and reports when
+	// the client hangs up
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	hungUp := make(chan int, 2)
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go func() {
+				io.Copy(io.Discard, c)
+				hungUp <- i
+			}()
+		}
+	}()
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	tr := d.HTTPTransport()
+	defer tr.CloseIdleConnections()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.test/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = tr.RoundTrip(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RoundTrip: got %v, want context.Canceled", err)
+	}
+
+	// http.Transport lets the dial itself run on, but the transport's
+	// dial function gives up when its context is canceled
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = tr.DialContext(ctx, "tcp", "example.test:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DialContext: got %v, want context.Canceled", err)
+	}
+	select {
+		case i := <-hungUp:
+			if i != 1 {
+				t.Errorf("connection %d to the proxy was closed, want the second one", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("the connection to the proxy was not closed")
+	}
+}
@@ -0,0 +1,171 @@
+package socks
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Punycode parameters, from RFC 3492.
+const (
+	punyBase		= 36
+	punyTMin		= 1
+	punyTMax		= 26
+	punySkew		= 38
+	punyDamp		= 700
+	punyInitialBias	= 72
+	punyInitialN	= 128
+)
+
+// toASCII converts an internationalized domain name to the form it takes in
+// the DNS: each label which is not plain ASCII is lower-cased and encoded with
+// Punycode, behind the "xn--" prefix, and all labels must be at most 63 bytes
+// long.  Names which are already ASCII are returned unchanged.  This covers
+// what clients of this package need of IDNA (RFC 5891), but it does not apply
+// Unicode normalization or the full set of IDNA2008 code point rules: names
+// are expected to be in NFC, as they almost always are, and labels are only
+// required to consist of letters, digits, combining marks and hyphens.
+func toASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidHostname
+	}
+
+	labels := strings.Split(strings.Map(normalizeDot, strings.ToLower(name)), ".")
+	// a trailing dot makes the name absolute
+	absolute := len(labels) > 1 && labels[len(labels)-1] == ""
+	if absolute {
+		labels = labels[:len(labels)-1]
+	}
+	var b strings.Builder
+	for i, label := range labels {
+		if label == "" {
+			return "", ErrInvalidHostname
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		if !isASCII(label) {
+			for _, r := range label {
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != '-' {
+					return "", ErrInvalidHostname
+				}
+			}
+			label = "xn--" + punycode(label)
+		} else if strings.ContainsFunc(label, unicode.IsControl) || strings.ContainsRune(label, ' ') {
+			return "", ErrInvalidHostname
+		}
+		if len(label) > 63 {
+			return "", ErrInvalidHostname
+		}
+		b.WriteString(label)
+	}
+	if absolute {
+		b.WriteByte('.')
+	}
+	if b.Len() > 0xFF {
+		return "", ErrHostnameTooLong
+	}
+	return b.String(), nil
+}
+
+// normalizeDot maps the ideographic and fullwidth full stops, which IDNA
+// treats as label separators, to '.'.
+func normalizeDot(r rune) rune {
+	switch r {
+		case '。', '．', '｡':
+			return '.'
+	}
+	return r
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode encodes s as described in RFC 3492, without the "xn--" prefix.
+// Labels are short enough that the integer overflow checks of the RFC are
+// not needed.
+func punycode(s string) string {
+	runes := []rune(s)
+	out := make([]byte, 0, 2*len(s))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		m := int(unicode.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -0,0 +1,132 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sample strings from RFC 3492, section 7.1.
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		// (A) Arabic (Egyptian)
+		{
+			"ليهمابتكلموشعربي؟",
+			"egbpdaj6bu4bxfgehfvwxn",
+		},
+		// (B) Chinese (simplified)
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		// (C) Chinese (traditional)
+		{"他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+		// (I) Russian (Cyrillic), in lower case
+		{
+			"почемужеонинеговорятпорусски",
+			"b1abfaaepdrnnbgefbadotcwatmq2g4l",
+		},
+		// (J) Spanish
+		{"PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+		// (L) 3<nen>B<gumi><kinpachi><sensei>
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		// (M) <amuro><namie>-with-SUPER-MONKEYS
+		{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+		// (R) <sono><supiido><de>
+		{"そのスピードで", "d9juau41awczczp"},
+		// (S) -> $1.00 <-
+		{"-> $1.00 <-", "-> $1.00 <--"},
+	}
+	for _, tt := range tests {
+		if got := punycode(tt.in); got != tt.want {
+			t.Errorf("punycode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want	string
+		err			error
+	}{
+		{"example.com", "example.com", nil},
+		{"bücher.example", "xn--bcher-kva.example", nil},
+		{"BÜCHER.example", "xn--bcher-kva.example", nil},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", nil},
+		{"bücher．example", "xn--bcher-kva.example", nil},
+		{"例え。テスト", "xn--r8jz45g.xn--zckzah", nil},
+		{"bücher.example.", "xn--bcher-kva.example.", nil},
+		{strings.Repeat("b", 60) + "ü.example", "", ErrInvalidHostname},
+		{"bücher..example", "", ErrInvalidHostname},
+		{"bü cher.example", "", ErrInvalidHostname},
+		{"bücher.exa mple", "", ErrInvalidHostname},
+		{"b\xFFcher.example", "", ErrInvalidHostname},
+		{strings.Repeat("bücher.", 40) + "example", "", ErrHostnameTooLong},
+	}
+	for _, tt := range tests {
+		got, err := toASCII(tt.in)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("toASCII(%q) = %q, %v; want %q, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+
+	// labels of ASCII names are left for the resolver to check
+	long := strings.Repeat("a", 64) + ".example"
+	if got, err := toASCII(long); got != long || err != nil {
+		t.Errorf("toASCII(%q) = %q, %v; want it unchanged", long, got, err)
+	}
+}
+
+func TestPacketConnIDNA(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	s := &Server{
+		AllowUDPAssociate:	true,
+		Resolver:			staticResolver{"xn--bcher-kva.test": {net.IPv4(127, 0, 0, 1)}},
+	}
+	d := &Dialer{ProxyAddr: startServer(t, s), Timeout: 5 * time.Second}
+	pc, err := d.ListenPacket(context.Background(), "udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dst := &Addr{Name: "bücher.test", Port: echo.LocalAddr().(*net.UDPAddr).Port}
+	_, err = pc.WriteTo([]byte("ping"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q back, want \"ping\"", buf[:n])
+	}
+	if dst.Name != "bücher.test" {
+		t.Errorf("WriteTo changed the address passed to it to %s", dst)
+	}
+
+	_, err = pc.WriteTo([]byte("ping"), &Addr{Name: "bü cher.test", Port: 1})
+	if !errors.Is(err, ErrInvalidHostname) {
+		t.Errorf("got %v, want ErrInvalidHostname", err)
+	}
+}
@@ -0,0 +1,118 @@
+package socks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements from a Dialer, for exporting to a monitoring
+// system such as Prometheus or expvar.  Its methods are called synchronously,
+// possibly from multiple goroutines at once, and should return quickly.
+type Metrics interface {
+	// DialDone is called when a request to a proxy has succeeded or failed,
+	// for every command, with err being nil or the error returned to the
+	// caller.
+	DialDone(stats *DialStats, err error)
+
+	// ConnClosed is called when a connection returned by Dial, DialContext
+	// or Client with no error is closed, with the number of bytes read from
+	// it and written to it.  It is only called for the first call to Close.
+	ConnClosed(stats *DialStats, read, written int64)
+}
+
+// DialStats describes a request sent to a proxy by a Dialer.  It is passed
+// to the methods of Metrics and to Dialer.ReportThroughput, which must not
+// modify it.
+type DialStats struct {
+	ID		string	// the dial ID, see WithDialID
+	Command	Command
+	Target	*Addr	// the target as given, before any local resolution
+
+	// Proxy is the proxy the request went to, or the last one tried if it
+	// failed.
+	Proxy	string
+
+	// Duration is the time the whole dial took, including any fallback
+	// proxies tried.
+	Duration	time.Duration
+
+	// HandshakeDuration is the time the SOCKS handshake (and the TLS
+	// handshake, if any) with Proxy took, excluding connecting to it.  It is
+	// zero if the proxy couldn't be reached.
+	HandshakeDuration	time.Duration
+}
+
+// Throughput reports on the traffic of a connection, for
+// Dialer.ReportThroughput.
+type Throughput struct {
+	Read	int64	// bytes read so far
+	Written	int64	// bytes written so far
+
+	// ReadRate and WriteRate are the rates, in bytes per second, since
+	// the previous report, or since the connection was established for the
+	// first one.
+	ReadRate	float64
+	WriteRate	float64
+
+	// Elapsed is the time since the connection was established.
+	Elapsed	time.Duration
+}
+
+// connCounter counts the bytes passing through a Conn, reports them to
+// Metrics, if not nil, when it is closed, and periodically if asked to with
+// reportThroughput.
+type connCounter struct {
+	metrics	Metrics
+	stats	*DialStats
+
+	read	atomic.Int64
+	written	atomic.Int64
+	closed	atomic.Bool
+	stop	chan struct{}	// closed on close if reporting throughput
+}
+
+// reportThroughput starts calling report every interval, until c is closed.
+func (c *connCounter) reportThroughput(interval time.Duration, report func(*DialStats, Throughput)) {
+	c.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		start := time.Now()
+		last := start
+		var lastRead, lastWritten int64
+		for {
+			select {
+				case <-c.stop:
+					return
+				case now := <-ticker.C:
+					// select picks at random when both are ready, so a
+					// tick may arrive after close
+					if c.closed.Load() {
+						return
+					}
+					read, written := c.read.Load(), c.written.Load()
+					secs := now.Sub(last).Seconds()
+					report(c.stats, Throughput{
+						Read:		read,
+						Written:	written,
+						ReadRate:	float64(read-lastRead) / secs,
+						WriteRate:	float64(written-lastWritten) / secs,
+						Elapsed:	now.Sub(start),
+					})
+					last, lastRead, lastWritten = now, read, written
+			}
+		}
+	}()
+}
+
+func (c *connCounter) close() {
+	if !c.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if c.stop != nil {
+		close(c.stop)
+	}
+	if c.metrics != nil {
+		c.metrics.ConnClosed(c.stats, c.read.Load(), c.written.Load())
+	}
+}
@@ -0,0 +1,121 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the calls to its methods.
+type recordingMetrics struct {
+	mu		sync.Mutex
+	dials	[]*DialStats
+	errs	[]error
+	closed	[][2]int64
+}
+
+func (m *recordingMetrics) DialDone(stats *DialStats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dials = append(m.dials, stats)
+	m.errs = append(m.errs, err)
+}
+
+func (m *recordingMetrics) ConnClosed(stats *DialStats, read, written int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = append(m.closed, [2]int64{read, written})
+}
+
+func TestMetrics(t *testing.T) {
+	echo := startEcho(t)
+	proxy := startServer(t, &Server{})
+	m := &recordingMetrics{}
+	d := &Dialer{ProxyAddr: proxy, Timeout: 5 * time.Second, Metrics: m}
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	if len(m.dials) != 1 || m.errs[0] != nil {
+		t.Fatalf("DialDone called with %v, want a single successful dial", m.errs)
+	}
+	stats := m.dials[0]
+	m.mu.Unlock()
+	if stats.Command != CommandConnect || stats.Target.String() != echo || stats.Proxy != proxy || stats.ID != conn.(*Conn).DialID() {
+		t.Errorf("got stats %+v for the dial", stats)
+	}
+	if stats.Duration <= 0 || stats.HandshakeDuration <= 0 || stats.HandshakeDuration > stats.Duration {
+		t.Errorf("got Duration %v and HandshakeDuration %v", stats.Duration, stats.HandshakeDuration)
+	}
+
+	// Write and Read
+	checkEcho(t, conn)
+	// ReadFrom, through io.Copy
+	payload := bytes.Repeat([]byte("x"), 1000)
+	n, err := io.Copy(conn, bytes.NewReader(payload))
+	if err != nil || n != 1000 {
+		t.Fatalf("io.Copy to the connection: %d, %v", n, err)
+	}
+	err = conn.(*Conn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WriteTo, through io.Copy
+	n, err = io.Copy(io.Discard, conn)
+	if err != nil || n != 1000 {
+		t.Fatalf("io.Copy from the connection: %d, %v", n, err)
+	}
+
+	conn.Close()
+	conn.Close()
+	m.mu.Lock()
+	if len(m.closed) != 1 || m.closed[0] != [2]int64{1012, 1012} {
+		t.Errorf("ConnClosed called with %v, want once with 1012 bytes each way", m.closed)
+	}
+	m.mu.Unlock()
+
+	// a failed dial is reported, with the error returned
+	d.ProxyAddr = "127.0.0.1:1"
+	_, err = d.Dial("tcp", echo)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.errs) != 2 || m.errs[1] == nil || m.errs[1] != err {
+		t.Errorf("DialDone called with %v, want the error %v", m.errs, err)
+	}
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || m.dials[1].Proxy != d.ProxyAddr || m.dials[1].HandshakeDuration != 0 {
+		t.Errorf("got stats %+v for the failed dial", m.dials[1])
+	}
+	if len(m.closed) != 1 {
+		t.Errorf("ConnClosed called %d times, want no call for the failed dial", len(m.closed))
+	}
+}
+
+func TestMetricsClient(t *testing.T) {
+	echo := startEcho(t)
+	client, server := net.Pipe()
+	go (&Server{}).ServeConn(server)
+	m := &recordingMetrics{}
+	d := &Dialer{Metrics: m}
+	conn, err := d.Client(context.Background(), client, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	conn.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.dials) != 1 || m.errs[0] != nil || m.dials[0].Proxy != "pipe" {
+		t.Errorf("DialDone called with %v, want a successful dial via pipe", m.errs)
+	}
+	if len(m.closed) != 1 || m.closed[0] != [2]int64{12, 12} {
+		t.Errorf("ConnClosed called with %v, want once with 12 bytes each way", m.closed)
+	}
+}
@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// probeTarget is the target of the requests sent by Probe.
+var probeTarget = &Addr{IP: net.IPv4(127, 0, 0, 1)}
+
+// ProbeResult is what Dialer.Probe found out about a proxy.
+type ProbeResult struct {
+	// Methods lists the METHOD values of the Dialer's authentication
+	// methods which the proxy selected when offered each on its own.
+	Methods	[]byte
+
+	// BindErr and UDPAssociateErr are nil if the proxy granted the BIND or
+	// UDP ASSOCIATE request, and otherwise the *HandshakeError it failed
+	// with, which wraps the ReplyCode if the proxy refused it.
+	BindErr			error
+	UDPAssociateErr	error
+
+	// HandshakeDuration is the time the SOCKS handshake for the BIND
+	// request took, excluding connecting to the proxy, as in DialStats.
+	HandshakeDuration	time.Duration
+}
+
+// Probe connects to d.ProxyAddr to find out what the proxy supports, always
+// speaking SOCKS5.  Each of the authentication methods a dial would offer is
+// offered in a greeting of its own, and counts as accepted if the proxy
+// selects it; the method's sub-negotiation is not carried out.  Then BIND and
+// UDP ASSOCIATE requests for a loopback address are sent as in a dial, and
+// their connections closed after the proxy's first reply, so no data is
+// relayed.  d.FallbackProxyAddrs and d.Bypass are not used, and d.Timeout
+// applies to the probe as a whole.  An error is only returned if the proxy
+// cannot be reached or does not answer a greeting, and is a *HandshakeError.
+func (d *Dialer) Probe(ctx context.Context) (*ProbeResult, error) {
+	dd := *d
+	dd.Version = VersionSocks5
+	id := dialID(ctx)
+	deadline := dd.deadline(ctx, time.Now())
+
+	result := new(ProbeResult)
+	for _, m := range dd.authMethods() {
+		accepted, err := dd.probeMethod(ctx, deadline, m.Method())
+		if err != nil {
+			return nil, err.withID(id)
+		}
+		if accepted {
+			result.Methods = append(result.Methods, m.Method())
+		}
+	}
+
+	var stats DialStats
+	result.BindErr = dd.probeCommand(ctx, deadline, CommandBind, id, &stats)
+	result.HandshakeDuration = stats.HandshakeDuration
+	result.UDPAssociateErr = dd.probeCommand(ctx, deadline, CommandUDPAssociate, id, nil)
+	return result, nil
+}
+
+// probeMethod offers only method to the proxy, and reports whether the proxy
+// selected it.
+func (d *Dialer) probeMethod(ctx context.Context, deadline time.Time, method byte) (bool, *HandshakeError) {
+	target := probeTarget.String()
+	conn, err := d.dialProxy(ctx, within(deadline, time.Now(), d.ConnectTimeout))
+	if err != nil {
+		return false, newHandshakeError(StageDial, d.ProxyAddr, target, err)
+	}
+	hsDeadline := within(deadline, time.Now(), d.HandshakeTimeout)
+	if d.TLSConfig != nil {
+		conn, err = d.tlsClient(ctx, hsDeadline, conn)
+		if err != nil {
+			return false, newHandshakeError(StageDial, d.ProxyAddr, target, err)
+		}
+	}
+	defer conn.Close()
+	if !hsDeadline.IsZero() {
+		conn.SetDeadline(hsDeadline)
+	}
+
+	stop := watchContext(ctx, conn)
+	var sel MethodSelection
+	b, err := (&Greeting{Methods: []byte{method}}).Marshal()
+	if err == nil {
+		_, err = conn.Write(b)
+	}
+	if err == nil {
+		_, err = sel.ReadFrom(conn)
+	}
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		return false, newHandshakeError(StageMethodNegotiation, d.ProxyAddr, target, err)
+	}
+	return sel.Method == method, nil
+}
+
+// probeCommand sends a request for cmd to probeTarget, and closes the
+// connection once the proxy has replied.
+func (d *Dialer) probeCommand(ctx context.Context, deadline time.Time, cmd Command, id string, stats *DialStats) error {
+	conn, err := d.dialOnce(ctx, deadline, cmd, probeTarget, probeTarget.String(), stats)
+	if err != nil {
+		return err.withID(id)
+	}
+	conn.Close()
+	return nil
+}
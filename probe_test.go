@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	s := &Server{
+		Credentials:		map[string]string{"user": "secret"},
+		AllowBind:			true,
+		AllowUDPAssociate:	true,
+	}
+	d := &Dialer{
+		ProxyAddr:	startServer(t, s),
+		Timeout:	5 * time.Second,
+		Auth:		&Auth{User: "user", Password: "secret"},
+	}
+	result, err := d.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Methods, []byte{socks5UsernamePassword}) {
+		t.Errorf("got methods %x, want only username/password", result.Methods)
+	}
+	if result.BindErr != nil || result.UDPAssociateErr != nil {
+		t.Errorf("got BIND %v and UDP ASSOCIATE %v, want both granted", result.BindErr, result.UDPAssociateErr)
+	}
+	if result.HandshakeDuration <= 0 {
+		t.Errorf("HandshakeDuration = %v", result.HandshakeDuration)
+	}
+
+	// the Version is ignored, and refusals are reported in the result
+	d = &Dialer{
+		ProxyAddr:	startServer(t, &Server{}),
+		Timeout:	5 * time.Second,
+		Version:	VersionSocks4a,
+	}
+	result, err = d.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Methods, []byte{0x00}) {
+		t.Errorf("got methods %x, want only no authentication", result.Methods)
+	}
+	if !errors.Is(result.BindErr, ReplyCommandNotSupported) || !errors.Is(result.UDPAssociateErr, ReplyCommandNotSupported) {
+		t.Errorf("got BIND %v and UDP ASSOCIATE %v, want both refused", result.BindErr, result.UDPAssociateErr)
+	}
+
+	// nothing listens on a port of a listener closed right away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	d.ProxyAddr = l.Addr().String()
+	_, err = d.Probe(WithDialID(ctx, "probe-1"))
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.Stage != StageDial || herr.ID != "probe-1" {
+		t.Errorf("got %v, want a dial stage error with ID probe-1", err)
+	}
+}
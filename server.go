@@ -0,0 +1,609 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const socks5NoAcceptableMethods byte	= 0xFF
+const socks5AuthFailure byte			= 0x01
+
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe after
+// a call to Server.Close.
+var ErrServerClosed = errors.New("SOCKS server closed")
+
+// A Resolver looks up host names for a Server, or for a Dialer resolving
+// target host names locally.  *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// A Server is a SOCKS5 proxy server.  The zero value is a usable server which
+// accepts clients without authentication and serves CONNECT requests.  Its
+// fields should not be modified once it has started serving.
+type Server struct {
+	// Credentials, if not nil, maps usernames to passwords.  Clients are
+	// then required to authenticate using username/password
+	// authentication; otherwise no authentication is required.
+	Credentials			map[string]string
+
+	// CredentialStore, if not nil, is used instead of Credentials to
+	// validate the credentials of clients, who are then required to
+	// authenticate.
+	CredentialStore		CredentialStore
+
+	// Rules, if not nil, decide which requests are served.  Otherwise all
+	// requests for enabled commands are.
+	Rules				Rules
+
+	// AllowBind and AllowUDPAssociate enable the BIND and UDP ASSOCIATE
+	// commands.  Disabled commands are answered with
+	// ReplyCommandNotSupported.
+	AllowBind			bool
+	AllowUDPAssociate	bool
+
+	// HandshakeTimeout is the maximum amount of time a client may take to
+	// complete the negotiation and send its request, including the time it
+	// takes the server to connect to the target.  Zero means no timeout.
+	HandshakeTimeout	time.Duration
+
+	// DialContext, if not nil, is used to connect to the targets of CONNECT
+	// requests instead of a zero net.Dialer.  It may, for example, connect
+	// through another proxy or from a specific source address.
+	DialContext			func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver, if not nil, is used to look up the host names of targets,
+	// and the resulting addresses are tried in order.  Otherwise, host names
+	// of CONNECT targets are passed to DialContext as they are, and those
+	// UDP datagrams are sent to are looked up with net.DefaultResolver.
+	Resolver			Resolver
+
+	mu			sync.Mutex
+	listeners	map[net.Listener]struct{}
+	conns		map[net.Conn]struct{}
+	closed		bool
+}
+
+// ListenAndServe listens on the given TCP network address and then calls
+// Serve to handle clients connecting to it.
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, and serves each one in a new goroutine.
+// Serve always returns a non-nil error, and closes l before returning.  After
+// Close, the returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			// back off on temporary errors such as running out of file
+			// descriptors, like net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// Close immediately closes all listeners passed to Serve, and all client
+// connections being served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+	return true
+}
+
+// ServeConn serves a single client connection, and closes it once the client
+// is done.  Serve calls ServeConn for each connection it accepts, but it may
+// also be called directly for connections obtained by other means.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	ctx := context.Background()
+	if s.HandshakeTimeout > 0 {
+		deadline := time.Now().Add(s.HandshakeTimeout)
+		if conn.SetDeadline(deadline) != nil {
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	if s.negotiate(conn) != nil {
+		return
+	}
+
+	var req Request
+	_, err := req.ReadFrom(conn)
+	if err != nil {
+		var perr *ProtocolError
+		if errors.As(err, &perr) && (perr.Err == ErrAddrType || perr.Err == ErrInvalidAddr) {
+			writeReply(conn, ReplyAddrTypeNotSupported, nil)
+		}
+		return
+	}
+
+	dst := ipLiteral(req.Dst)
+	switch {
+		case req.Command == CommandConnect:
+		case req.Command == CommandBind && s.AllowBind:
+		case req.Command == CommandUDPAssociate && s.AllowUDPAssociate:
+		default:
+			writeReply(conn, ReplyCommandNotSupported, nil)
+			return
+	}
+	// UDP ASSOCIATE is checked for each datagram instead
+	if req.Command != CommandUDPAssociate && !s.allow(conn, dst, req.Command) {
+		writeReply(conn, ReplyNotAllowed, nil)
+		return
+	}
+
+	switch req.Command {
+		case CommandConnect:
+			s.connect(ctx, conn, dst)
+		case CommandBind:
+			s.bind(conn, dst)
+		case CommandUDPAssociate:
+			s.udpAssociate(conn, dst)
+	}
+}
+
+// allow consults s.Rules about a request from the client at the other end of
+// conn.
+func (s *Server) allow(conn net.Conn, dst *Addr, cmd Command) bool {
+	return s.Rules == nil || s.Rules.Allow(conn.RemoteAddr(), dst, cmd)
+}
+
+// credentials returns the CredentialStore to validate clients' credentials
+// with, or nil if clients need not authenticate.
+func (s *Server) credentials() CredentialStore {
+	if s.CredentialStore != nil {
+		return s.CredentialStore
+	}
+	if s.Credentials != nil {
+		return StaticCredentials(s.Credentials)
+	}
+	return nil
+}
+
+// negotiate reads the client's greeting, selects an authentication method and
+// authenticates the client.
+func (s *Server) negotiate(conn net.Conn) error {
+	var greeting Greeting
+	_, err := greeting.ReadFrom(conn)
+	if err != nil {
+		return err
+	}
+
+	want := socks5NoAuthentication
+	if s.credentials() != nil {
+		want = socks5UsernamePassword
+	}
+	method := socks5NoAcceptableMethods
+	for _, m := range greeting.Methods {
+		if m == want {
+			method = want
+			break
+		}
+	}
+	_, err = (&MethodSelection{Method: method}).WriteTo(conn)
+	if err != nil {
+		return err
+	}
+	switch method {
+		case socks5NoAcceptableMethods:
+			return &ProtocolError{ErrMethodNegotiation, method}
+		case socks5UsernamePassword:
+			return s.authenticate(conn)
+	}
+	return nil
+}
+
+// authenticate performs the server side of the username/password
+// sub-negotiation.
+func (s *Server) authenticate(conn net.Conn) error {
+	var buf [1+0xFF]byte
+
+	_, err := readFull(conn, buf[:2], false)
+	if err != nil {
+		return err
+	}
+	if buf[0] != socks5AuthVersion {
+		return &ProtocolError{ErrAuthVersion, buf[0]}
+	}
+	user := make([]byte, buf[1])
+	_, err = readFull(conn, user, true)
+	if err != nil {
+		return err
+	}
+	_, err = readFull(conn, buf[:1], true)
+	if err != nil {
+		return err
+	}
+	password := buf[1:1+int(buf[0])]
+	_, err = readFull(conn, password, true)
+	if err != nil {
+		return err
+	}
+
+	valid := s.credentials().Valid(string(user), string(password))
+	for i := range password {
+		password[i] = 0
+	}
+
+	status := socks5AuthSuccess
+	if !valid {
+		status = socks5AuthFailure
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, status})
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return &ProtocolError{ErrAuthFailed, status}
+	}
+	return nil
+}
+
+// connect serves a CONNECT request.
+func (s *Server) connect(ctx context.Context, conn net.Conn, dst *Addr) {
+	target, err := s.dialTarget(ctx, dst)
+	if err != nil {
+		writeReply(conn, dialErrorReply(err), nil)
+		return
+	}
+	defer target.Close()
+
+	if writeReply(conn, ReplySucceeded, tcpAddr(target.LocalAddr())) != nil {
+		return
+	}
+	if conn.SetDeadline(time.Time{}) != nil {
+		return
+	}
+	relay(conn, target)
+}
+
+// dialTarget connects to the target of a CONNECT request.
+func (s *Server) dialTarget(ctx context.Context, dst *Addr) (net.Conn, error) {
+	dial := s.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	if dst.IP != nil || s.Resolver == nil {
+		return dial(ctx, "tcp", dst.String())
+	}
+
+	ips, err := s.lookupIP(ctx, dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var target net.Conn
+		target, err = dial(ctx, "tcp", (&Addr{IP: ip, Port: dst.Port}).String())
+		if err == nil {
+			return target, nil
+		}
+	}
+	return nil, err
+}
+
+// lookupIP looks up host using s.Resolver, or net.DefaultResolver.  Unlike
+// the Resolver, it never returns an empty list without an error.
+func (s *Server) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r := s.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, err
+}
+
+// bind serves a BIND request.  The server listens on the address the client
+// reached it at, and waits for a single connection from dst.
+func (s *Server) bind(conn net.Conn, dst *Addr) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: tcpAddr(conn.LocalAddr()).IP})
+	if err != nil {
+		writeReply(conn, ReplyGeneralFailure, nil)
+		return
+	}
+	defer l.Close()
+
+	if writeReply(conn, ReplySucceeded, tcpAddr(l.Addr())) != nil {
+		return
+	}
+	// the peer may take a while to show up
+	if conn.SetDeadline(time.Time{}) != nil {
+		return
+	}
+
+	// Stop waiting if the client goes away.  The client has no business
+	// sending anything before our second reply, so if it does, give up on it.
+	var clientGone bool
+	watchDone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		_, err := conn.Read(b[:])
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			clientGone = true
+			l.Close()
+		}
+		close(watchDone)
+	}()
+	peer, err := l.AcceptTCP()
+	conn.SetReadDeadline(aLongTimeAgo)
+	<-watchDone
+	if err != nil || clientGone {
+		if peer != nil {
+			peer.Close()
+		}
+		return
+	}
+	defer peer.Close()
+	if conn.SetReadDeadline(time.Time{}) != nil {
+		return
+	}
+
+	peerAddr := tcpAddr(peer.RemoteAddr())
+	if dst.IP != nil && !dst.IP.IsUnspecified() && !dst.IP.Equal(peerAddr.IP) {
+		writeReply(conn, ReplyNotAllowed, nil)
+		return
+	}
+	if writeReply(conn, ReplySucceeded, peerAddr) != nil {
+		return
+	}
+	relay(conn, peer)
+}
+
+// udpAssociate serves a UDP ASSOCIATE request.  The association lasts until
+// the client closes its connection.
+func (s *Server) udpAssociate(conn net.Conn, dst *Addr) {
+	clientIP := tcpAddr(conn.RemoteAddr()).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr(conn.LocalAddr()).IP})
+	if err != nil {
+		writeReply(conn, ReplyGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+
+	bound := pc.LocalAddr().(*net.UDPAddr)
+	if writeReply(conn, ReplySucceeded, &Addr{IP: bound.IP, Port: bound.Port}) != nil {
+		return
+	}
+	if conn.SetDeadline(time.Time{}) != nil {
+		return
+	}
+	// the handshake's context may expire long before the association does,
+	// so name lookups are bound to the control connection instead
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+		pc.Close()
+	}()
+
+	// The client is the first sender from the client's IP address (and
+	// port, if it told us one).  Datagrams from anyone else are only relayed
+	// back to the client if the client has sent something to them first.
+	var client *net.UDPAddr
+	peers := make(map[string]struct{})
+	buf := make([]byte, 0xFFFF)
+	var out []byte
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil && (clientIP.IsUnspecified() || from.IP.Equal(clientIP)) && (dst.Port == 0 || dst.Port == from.Port) {
+			client = from
+		}
+		if client == nil {
+			continue
+		}
+
+		if from.IP.Equal(client.IP) && from.Port == client.Port {
+			var hdr UDPHeader
+			hdrLen, err := hdr.Unmarshal(buf[:n])
+			// we don't do reassembly
+			if err != nil || hdr.Frag != 0 {
+				continue
+			}
+			target := ipLiteral(hdr.Addr)
+			if !s.allow(conn, target, CommandUDPAssociate) {
+				continue
+			}
+			targetAddr, err := s.resolveUDPAddr(ctx, target)
+			if err != nil {
+				continue
+			}
+			peers[targetAddr.String()] = struct{}{}
+			pc.WriteToUDP(buf[hdrLen:n], targetAddr)
+		} else if _, ok := peers[from.String()]; ok {
+			hdr := UDPHeader{Addr: &Addr{IP: from.IP, Port: from.Port}}
+			out, _ = hdr.appendTo(out[:0])
+			out = append(out, buf[:n]...)
+			pc.WriteToUDP(out, client)
+		}
+	}
+}
+
+// ipLiteral returns a with its host name replaced by the IP address it spells
+// out, if it is an IP address literal, so that Rules see the address that is
+// going to be used.  Any IPv6 zone is dropped.
+func ipLiteral(a *Addr) *Addr {
+	if a.IP != nil {
+		return a
+	}
+	ip, err := netip.ParseAddr(a.Name)
+	if err != nil {
+		return a
+	}
+	return &Addr{IP: net.IP(ip.WithZone("").AsSlice()), Port: a.Port}
+}
+
+// resolveUDPAddr returns the UDP address for a, looking up its host name if
+// it has one.
+func (s *Server) resolveUDPAddr(ctx context.Context, a *Addr) (*net.UDPAddr, error) {
+	if a.IP != nil {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}, nil
+	}
+	ips, err := s.lookupIP(ctx, a.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: a.Port}, nil
+}
+
+// writeReply sends a reply to the client.  A nil bound address is sent as the
+// IPv4 address 0.0.0.0 and port 0.
+func writeReply(conn net.Conn, code ReplyCode, bound *Addr) error {
+	_, err := (&Reply{Code: code, Bound: bound}).WriteTo(conn)
+	return err
+}
+
+// dialErrorReply maps an error from connecting to a target to the most
+// fitting reply code.
+func dialErrorReply(err error) ReplyCode {
+	var dnsErr *net.DNSError
+	switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return ReplyConnectionRefused
+		case errors.Is(err, syscall.ENETUNREACH):
+			return ReplyNetworkUnreachable
+		case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+			return ReplyHostUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ReplyTTLExpired
+	}
+	return ReplyGeneralFailure
+}
+
+// tcpAddr converts a net.Addr to an *Addr.  Connections handed to ServeConn
+// need not be TCP connections; their addresses are treated as 0.0.0.0:0.
+func tcpAddr(a net.Addr) *Addr {
+	t, ok := a.(*net.TCPAddr)
+	if !ok {
+		return &Addr{IP: net.IPv4zero}
+	}
+	return &Addr{IP: t.IP, Port: t.Port}
+}
+
+// relay copies data in both directions between a and b until both sides have
+// finished sending, passing on half-closes where possible.
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		copyAndClose(b, a)
+		close(done)
+	}()
+	copyAndClose(a, b)
+	<-done
+}
+
+// copyAndClose copies from src to dst.  Once src is exhausted, the write side
+// of dst is closed, or all of dst if it cannot be half-closed.  If the copy
+// fails, both connections are closed so that the copy in the other direction
+// stops too.
+func copyAndClose(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	// a *Conn has CloseWrite even when the connection under it does not
+	if cw, ok := dst.(interface{ CloseWrite() error }); !ok || cw.CloseWrite() != nil {
+		dst.Close()
+	}
+}
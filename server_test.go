@@ -0,0 +1,403 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves s on a loopback port until the end of the test, and
+// returns the address to reach it at.
+func startServer(t testing.TB, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// startEcho runs a TCP server echoing back what it receives until the end of
+// the test, and returns its address.
+func startEcho(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// checkEcho writes a message to conn and checks that it comes back.
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("hello, world")
+	_, err := conn.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Fatalf("got %q back, want %q", got, msg)
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	echo := startEcho(t)
+	d := &Dialer{ProxyAddr: startServer(t, &Server{}), Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	c := conn.(*Conn)
+	if got := c.RemoteAddr().String(); got != echo {
+		t.Errorf("RemoteAddr() = %s, want %s", got, echo)
+	}
+	if got := c.Proxy(); got != d.ProxyAddr {
+		t.Errorf("Proxy() = %s, want %s", got, d.ProxyAddr)
+	}
+	if bound := c.BoundAddr().(*Addr); bound.IP == nil || bound.Port == 0 {
+		t.Errorf("BoundAddr() = %s, want the proxy's address", bound)
+	}
+}
+
+func TestServerConnectHostname(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	var mu sync.Mutex
+	var dsts []*Addr
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			mu.Lock()
+			dsts = append(dsts, dst)
+			mu.Unlock()
+			return true
+		}),
+		Resolver: staticResolver{"echo.test": {net.IPv4(127, 0, 0, 1)}},
+	}
+	d := &Dialer{ProxyAddr: startServer(t, s), Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dsts) != 1 || dsts[0].Name != "echo.test" {
+		t.Errorf("server got requests for %v, want echo.test", dsts)
+	}
+}
+
+// staticResolver is a Resolver answering from a map.
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestServerAuth(t *testing.T) {
+	echo := startEcho(t)
+	proxy := startServer(t, &Server{Credentials: map[string]string{"user": "secret"}})
+
+	d := &Dialer{ProxyAddr: proxy, Auth: &Auth{User: "user", Password: "secret"}}
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+
+	d.Auth.Password = "wrong"
+	_, err = d.Dial("tcp", echo)
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.Stage != StageAuth || !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("dial with wrong password: got %v, want ErrAuthFailed at the auth stage", err)
+	}
+
+	d.Auth = nil
+	_, err = d.Dial("tcp", echo)
+	if !errors.As(err, &herr) || herr.Stage != StageMethodNegotiation || !errors.Is(err, ErrMethodNegotiation) {
+		t.Errorf("dial without credentials: got %v, want ErrMethodNegotiation", err)
+	}
+}
+
+func TestServerRefusals(t *testing.T) {
+	echo := startEcho(t)
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			return dst.Port != 1
+		}),
+	}
+	d := &Dialer{ProxyAddr: startServer(t, s)}
+
+	_, err := d.Dial("tcp", "127.0.0.1:1")
+	if !errors.Is(err, ReplyNotAllowed) || !errors.Is(err, ErrRequestFailed) {
+		t.Errorf("dial to denied target: got %v, want ReplyNotAllowed", err)
+	}
+	var herr *HandshakeError
+	if errors.As(err, &herr) && herr.ReplyCode != ReplyNotAllowed {
+		t.Errorf("ReplyCode = %v, want %v", herr.ReplyCode, ReplyNotAllowed)
+	}
+
+	_, err = d.Bind(context.Background(), echo)
+	if !errors.Is(err, ReplyCommandNotSupported) {
+		t.Errorf("BIND with AllowBind unset: got %v, want ReplyCommandNotSupported", err)
+	}
+}
+
+func TestServerBind(t *testing.T) {
+	d := &Dialer{ProxyAddr: startServer(t, &Server{AllowBind: true}), Timeout: 5 * time.Second}
+	b, err := d.Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	peer, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := b.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, want := b.PeerAddr().String(), peer.LocalAddr().String(); got != want {
+		t.Errorf("PeerAddr() = %s, want %s", got, want)
+	}
+
+	go io.Copy(peer, peer)
+	checkEcho(t, conn)
+}
+
+func TestServerUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	d := &Dialer{ProxyAddr: startServer(t, &Server{AllowUDPAssociate: true}), Timeout: 5 * time.Second}
+	pc, err := d.ListenPacket(context.Background(), "udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = pc.WriteTo([]byte("ping"), echo.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+		t.Errorf("got %q from %s, want \"ping\" from %s", buf[:n], from, echo.LocalAddr())
+	}
+}
+
+// ctxResolver is a staticResolver which fails once its context is done, as
+// real resolvers do.
+type ctxResolver staticResolver
+
+func (r ctxResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	return staticResolver(r).LookupIP(ctx, network, host)
+}
+
+func TestServerUDPAssociateAfterHandshakeTimeout(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	s := &Server{
+		AllowUDPAssociate:	true,
+		HandshakeTimeout:	100 * time.Millisecond,
+		Resolver:			ctxResolver{"echo.test": {net.IPv4(127, 0, 0, 1)}},
+	}
+	d := &Dialer{ProxyAddr: startServer(t, s), Timeout: 5 * time.Second}
+	pc, err := d.ListenPacket(context.Background(), "udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// the association must outlive the handshake's deadline
+	time.Sleep(200 * time.Millisecond)
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	dst := &Addr{Name: "echo.test", Port: echo.LocalAddr().(*net.UDPAddr).Port}
+	_, err = pc.WriteTo([]byte("ping"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no answer to a datagram sent after HandshakeTimeout: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q back, want \"ping\"", buf[:n])
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := &Server{}
+	proxy := startServer(t, s)
+	d := &Dialer{ProxyAddr: proxy, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", startEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("Read on a relayed connection succeeded after Close")
+	}
+	_, err = d.Dial("tcp", startEcho(t))
+	if err == nil {
+		t.Error("dial succeeded after Close")
+	}
+}
+
+// rawRequest sends req to the proxy at addr, without authentication, and
+// returns the code of the reply.
+func rawRequest(t *testing.T, addr string, req *Request) ReplyCode {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := (&Greeting{Methods: []byte{0x00}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// requests the encoders refuse are sent as raw bytes
+	b = append(b, 0x05, byte(req.Command), 0x00)
+	if req.Dst.IP == nil {
+		b = append(b, 0x03, byte(len(req.Dst.Name)))
+		b = append(b, req.Dst.Name...)
+		b = append(b, byte(req.Dst.Port>>8), byte(req.Dst.Port))
+	} else {
+		b, err = req.Dst.appendTo(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sel MethodSelection
+	_, err = sel.ReadFrom(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Reply
+	_, err = reply.ReadFrom(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.Code
+}
+
+func TestServerTargetNames(t *testing.T) {
+	_, p, _ := net.SplitHostPort(startEcho(t))
+	port, _ := strconv.Atoi(p)
+	var mu sync.Mutex
+	var seen []*Addr
+	s := &Server{
+		Rules: RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			mu.Lock()
+			seen = append(seen, dst)
+			mu.Unlock()
+			return dst.IP == nil || !dst.IP.IsLoopback()
+		}),
+	}
+	proxy := startServer(t, s)
+
+	// an empty name is not the proxy's own host
+	code := rawRequest(t, proxy, &Request{Command: CommandConnect, Dst: &Addr{Port: port}})
+	if code != ReplyAddrTypeNotSupported {
+		t.Errorf("request for an empty host name: got %v, want %v", code, ReplyAddrTypeNotSupported)
+	}
+
+	// IP literals sent as names are checked as IP addresses
+	for _, name := range []string{"127.0.0.1", "::1", "::ffff:127.0.0.1"} {
+		code = rawRequest(t, proxy, &Request{Command: CommandConnect, Dst: &Addr{Name: name, Port: port}})
+		if code != ReplyNotAllowed {
+			t.Errorf("request for %q: got %v, want %v", name, code, ReplyNotAllowed)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, dst := range seen {
+		if dst.IP == nil {
+			t.Errorf("Rules saw %v, want only IP addresses", dst)
+		}
+	}
+}
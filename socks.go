@@ -1,111 +1,221 @@
 /*
- * Package socks implements a SOCKS5 proxy client.
+ * Package socks implements a SOCKS5 proxy client and server.
+ *
+ * DialSocks5Timeout covers the simple case of connecting through a proxy
+ * with a timeout.  A Dialer holds the configuration for connecting through
+ * a proxy, and can be shared across connections.  Server is the server side
+ * counterpart.  The messages they exchange are available as the Greeting,
+ * MethodSelection, Request, Reply and UDPHeader types.
 */
 package socks
 
 import (
-	"errors"
+	"context"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
-const socks5Connect byte			= 0x01
 const socks5IPv4Addr byte			= 0x01
 const socks5DomainName byte			= 0x03
 const socks5IPv6Addr byte			= 0x04
 const socks5NoAuthentication byte	= 0x00
+const socks5GSSAPI byte				= 0x01
+const socks5UsernamePassword byte	= 0x02
 const socks5RequestGranted byte		= 0x00
 const socks5Version byte			= 0x05
 
-
 // DialSocks5Timeout dials to targetAddr through the specified proxy.  The
 // "proxy" argument should be in the format expected by net.SplitHostPort.  The
-// connection's deadline will be set to time.Now() + timeout.  Authentication
-// is not supported.
-func DialSocks5Timeout(proxy, targetAddr string, timeout time.Duration) (conn net.Conn, err error) {
-	var resp [18]byte
+// timeout covers both connecting to the proxy and the SOCKS handshake; the
+// returned connection has no deadline.  Only NoAuthentication is offered to
+// the proxy; see DialSocks5TimeoutAuth.  The returned connection is a *Conn,
+// and any error returned is a *HandshakeError.
+func DialSocks5Timeout(proxy, targetAddr string, timeout time.Duration) (net.Conn, error) {
+	return DialSocks5TimeoutAuth(proxy, targetAddr, timeout, nil)
+}
 
-	now := time.Now()
-	conn, err = net.DialTimeout("tcp", proxy, timeout)
-	if err != nil {
-		return nil, err
-	}
+// DialSocks5TimeoutAuth is like DialSocks5Timeout, but if auth is not nil,
+// also offers username/password authentication to the proxy and
+// authenticates with the supplied credentials if the proxy selects it.
+func DialSocks5TimeoutAuth(proxy, targetAddr string, timeout time.Duration, auth *Auth) (net.Conn, error) {
+	d := &Dialer{
+		ProxyAddr:	proxy,
+		Auth:		auth,
+		Timeout:	timeout,
+	}
+	return d.Dial("tcp", targetAddr)
+}
+
+// DialSocks5Context dials to targetAddr through the specified proxy.  The
+// dial and the SOCKS handshake are aborted if ctx is cancelled or its
+// deadline expires before they complete.  Only NoAuthentication is offered to
+// the proxy.  Any error returned is a *HandshakeError.
+func DialSocks5Context(ctx context.Context, proxy, targetAddr string) (net.Conn, error) {
+	d := &Dialer{ProxyAddr: proxy}
+	return d.DialContext(ctx, "tcp", targetAddr)
+}
+
+// handshakeBufLen is large enough for a greeting offering 255 methods,
+// followed by a request for a 255-byte domain name, and thus for any reply.
+const handshakeBufLen = 2 + 0xFF + 3 + maxAddrLen
 
-	// use the time.Now() taken at the beginning of the function
-	err = conn.SetDeadline(now.Add(timeout))
+type handshakeBuf [handshakeBufLen]byte
+
+// handshakeBufPool holds the buffers handshakes are encoded and decoded in, so
+// that a dial produces little garbage beyond the returned values.
+var handshakeBufPool = sync.Pool{
+	New: func() any { return new(handshakeBuf) },
+}
+
+// socks5Handshake negotiates one of the offered authentication methods with
+// the proxy at the other end of conn, and then sends a request for cmd to dst.
+// If pipeline is set and NoAuthentication is the only method offered, the
+// request is sent right after the greeting, in the same write, instead of
+// waiting for the proxy's method selection.  On success, the connection to
+// use from then on (which is conn, unless the authentication method
+// encapsulates traffic) and the address the proxy sent in its reply are
+// returned.  On failure, the stage at which the handshake failed is returned
+// alongside the error.  prepare, if not nil, is Dialer.PrepareRequest.  trace
+// may be nil.
+func socks5Handshake(conn net.Conn, cmd Command, dst *Addr, methods []AuthMethod, pipeline bool, prepare func(*Request) ([]byte, error), trace *ClientTrace) (net.Conn, *Addr, Stage, error) {
+	buf := handshakeBufPool.Get().(*handshakeBuf)
+	defer handshakeBufPool.Put(buf)
+
+	req := outgoingRequest{Request: Request{Command: cmd, Dst: dst}}
+	if prepare != nil {
+		// a copy goes to the hook, so that req need not live on the heap
+		// when there is none
+		prepared := req.Request
+		trailer, err := prepare(&prepared)
+		if err != nil {
+			return nil, nil, StageConnect, err
+		}
+		req = outgoingRequest{Request: prepared, trailer: trailer}
+	}
+	pipeline = pipeline && len(methods) == 1 && methods[0] == NoAuthentication
+	conn, stage, err := socks5Negotiate(conn, methods, buf, pipeline, &req, trace)
 	if err != nil {
-		return nil, err
+		return nil, nil, stage, err
 	}
+	bound, err := socks5Request(conn, &req, buf, pipeline, trace)
+	return conn, bound, StageConnect, err
+}
 
-	// initial greeting; only offer NoAuthentication
-	_, err = conn.Write([]byte{socks5Version, 1, socks5NoAuthentication})
+// socks5Negotiate sends the greeting offering methods, followed by req if
+// pipeline is set, and performs the sub-negotiation for the authentication
+// method the proxy selects.
+func socks5Negotiate(conn net.Conn, methods []AuthMethod, buf *handshakeBuf, pipeline bool, req *outgoingRequest, trace *ClientTrace) (net.Conn, Stage, error) {
+	if len(methods) == 0 || len(methods) > 0xFF {
+		return nil, StageMethodNegotiation, ErrAuthMethods
+	}
+	b := append(buf[:0], socks5Version, byte(len(methods)))
+	for _, m := range methods {
+		b = append(b, m.Method())
+	}
+	greetingLen := len(b)
+	if pipeline {
+		var err error
+		b, err = req.appendTo(b)
+		if err != nil {
+			return nil, StageConnect, err
+		}
+	}
+	_, err := conn.Write(b)
+	trace.wroteGreeting(b[2:greetingLen], err)
+	if pipeline {
+		trace.wroteRequest(req.Command, req.Dst, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, StageMethodNegotiation, err
 	}
 
 	// server responds with the chosen auth method
-	_, err = io.ReadFull(conn, resp[:2])
-	if err != nil {
-		return nil, err
-	}
-	if resp[0] != socks5Version {
-		return nil, errors.New("SOCKS proxy server does not support SOCKS5")
-	}
-	if resp[1] != socks5NoAuthentication {
-		return nil, fmt.Errorf("SOCKS authentication method negotiation failed; expected %x, got %x", socks5NoAuthentication, resp[1])
+	var sel MethodSelection
+	_, err = readFull(conn, buf[:2], false)
+	if err == nil {
+		_, err = sel.Unmarshal(buf[:2])
 	}
+	trace.gotMethodSelection(sel.Method, err)
+	if err != nil {
+		return nil, StageMethodNegotiation, err
+	}
+	for _, m := range methods {
+		if m.Method() == sel.Method {
+			conn, err = m.Negotiate(conn)
+			if err != nil {
+				return nil, StageAuth, err
+			}
+			return conn, StageAuth, nil
+		}
+	}
+	return nil, StageMethodNegotiation, &ProtocolError{ErrMethodNegotiation, sel.Method}
+}
 
-	// connection request
-	host, port, err := splitHostPort(targetAddr)
+// socks5Request sends req, unless it was already sent with the greeting, and
+// reads the proxy's reply.
+func socks5Request(conn net.Conn, req *outgoingRequest, buf *handshakeBuf, pipelined bool, trace *ClientTrace) (*Addr, error) {
+	if !pipelined {
+		b, err := req.appendTo(buf[:0])
+		if err == nil {
+			_, err = conn.Write(b)
+		}
+		trace.wroteRequest(req.Command, req.Dst, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bound, err := readReply(conn, buf[:0], trace)
 	if err != nil {
 		return nil, err
 	}
-	hostBytes := []byte(host)
-	if len(hostBytes) > 0xFF {
-		return nil, fmt.Errorf("hostname %s over maximum length %d", host, 0xFF)
+	// only RESOLVE_PTR has any use for a name in the reply
+	if bound.IP == nil && req.Command != CommandResolvePtr {
+		return nil, &ProtocolError{ErrAddrType, socks5DomainName}
 	}
-	req := []byte{socks5Version, socks5Connect, 0x00,
-				  socks5DomainName, byte(len(hostBytes))}
-	req = append(req, hostBytes...)
-	req = append(req, htons(port)...)
-	_, err = conn.Write(req)
+	return bound, nil
+}
+
+// outgoingRequest is a request as the client sends it: possibly modified by
+// Dialer.PrepareRequest, and followed by the bytes it returned.
+type outgoingRequest struct {
+	Request
+	trailer	[]byte
+}
+
+func (q *outgoingRequest) appendTo(b []byte) ([]byte, error) {
+	b, err := q.Request.appendTo(b)
 	if err != nil {
 		return nil, err
 	}
+	return append(b, q.trailer...), nil
+}
+
+// readReply reads a reply to a request, and returns the address in it.  buf,
+// if it has enough capacity, is used to read the reply into.
+func readReply(r io.Reader, buf []byte, trace *ClientTrace) (*Addr, error) {
+	var reply Reply
 
 	// server responds with OK / failure
-	_, err = io.ReadFull(conn, resp[:4])
-	if err != nil {
-		return nil, err
+	_, err := reply.readFrom(r, buf)
+	if reply.Code != ReplySucceeded && err == nil {
+		err = reply.Code
 	}
-	if resp[0] != socks5Version {
-		return nil, fmt.Errorf("SOCKS version %x is not 5", resp[0])
+	trace.gotReply(reply.Code, reply.Bound, err)
+	if reply.Code != ReplySucceeded {
+		return nil, reply.Code
 	}
-	if resp[1] != socks5RequestGranted {
-		return nil, fmt.Errorf("could not complete SOCKS5 connection: %x", resp[1])
-	}
-	if resp[2] != 0x00 {
-		return nil, fmt.Errorf("SOCKS5: reserved byte %x is not 0x00", resp[2])
-	}
-	switch resp[3] {
-		case socks5IPv4Addr:
-			_, err = io.ReadFull(conn, resp[:4+2])
-		case socks5IPv6Addr:
-			_, err = io.ReadFull(conn, resp[:16+2])
-		default:
-			return nil, fmt.Errorf("invalid address type %x in CONNECT response", resp[3])
+	if err != nil {
+		return nil, err
 	}
-	return conn, err
+	return reply.Bound, nil
 }
 
 func htons(n uint16) []byte {
-	var d [2]byte
-	binary.BigEndian.PutUint16(d[:], n)
-	return d[:]
+	return binary.BigEndian.AppendUint16(nil, n)
 }
 
 func splitHostPort(addr string) (host string, port uint16, err error) {
@@ -0,0 +1,120 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const socks4Version byte			= 0x04
+const socks4RequestGranted byte		= 90
+const socks4RequestRejected byte	= 91
+const socks4NoIdentd byte			= 92
+const socks4IdentdMismatch byte		= 93
+
+// Version is the SOCKS protocol version a Dialer speaks to the proxy.
+type Version int
+
+const (
+	VersionSocks5	Version = iota	// SOCKS5 only
+	VersionSocks4					// SOCKS4; host names are always resolved locally
+	VersionSocks4a					// SOCKS4a, which adds host names to SOCKS4
+	VersionAuto						// SOCKS5, falling back to SOCKS4a if the proxy rejects the greeting
+)
+
+// DialSocks4Timeout is like DialSocks5Timeout, but speaks SOCKS4 to the
+// proxy.  SOCKS4 can only carry IPv4 addresses, so target host names are
+// resolved locally.
+func DialSocks4Timeout(proxy, targetAddr string, timeout time.Duration) (net.Conn, error) {
+	d := &Dialer{
+		ProxyAddr:	proxy,
+		Timeout:	timeout,
+		Version:	VersionSocks4,
+	}
+	return d.Dial("tcp", targetAddr)
+}
+
+// DialSocks4aTimeout is like DialSocks5Timeout, but speaks SOCKS4a to the
+// proxy.
+func DialSocks4aTimeout(proxy, targetAddr string, timeout time.Duration) (net.Conn, error) {
+	d := &Dialer{
+		ProxyAddr:	proxy,
+		Timeout:	timeout,
+		Version:	VersionSocks4a,
+	}
+	return d.Dial("tcp", targetAddr)
+}
+
+// socks4Handshake sends a SOCKS4 request for cmd to dst, and reads the
+// proxy's reply.  If socks4a is set, host names are sent as such; otherwise
+// dst must be an IPv4 address.  user is sent as the USERID field.
+func socks4Handshake(conn net.Conn, cmd Command, dst *Addr, user string, socks4a bool) (*Addr, error) {
+	if cmd != CommandConnect && cmd != CommandBind {
+		return nil, ErrSocks4Command
+	}
+	if strings.IndexByte(user, 0) >= 0 {
+		return nil, ErrInvalidCredentials
+	}
+
+	req := make([]byte, 0, 8+len(user)+1+len(dst.Name)+1)
+	req = append(req, socks4Version, byte(cmd))
+	req = append(req, htons(uint16(dst.Port))...)
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		req = append(req, ip4...)
+		req = append(req, user...)
+		req = append(req, 0x00)
+	} else if dst.IP == nil && socks4a && strings.IndexByte(dst.Name, 0) < 0 {
+		// an address of 0.0.0.x, with x non-zero, says that the host name
+		// follows the user ID
+		req = append(req, 0x00, 0x00, 0x00, 0x01)
+		req = append(req, user...)
+		req = append(req, 0x00)
+		req = append(req, dst.Name...)
+		req = append(req, 0x00)
+	} else {
+		return nil, ErrSocks4Addr
+	}
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	return readSocks4Reply(conn)
+}
+
+// readSocks4Reply reads a SOCKS4 reply, and returns the address in it.
+func readSocks4Reply(r io.Reader) (*Addr, error) {
+	var resp [8]byte
+
+	_, err := readFull(r, resp[:], false)
+	if err != nil {
+		return nil, err
+	}
+	// The version should be 0, but some servers send 4.
+	if resp[0] != 0x00 && resp[0] != socks4Version {
+		return nil, &ProtocolError{ErrSocks4ReplyVersion, resp[0]}
+	}
+	switch resp[1] {
+		case socks4RequestGranted:
+		case socks4NoIdentd, socks4IdentdMismatch:
+			return nil, &ProtocolError{ErrSocks4Ident, resp[1]}
+		default:
+			return nil, &ProtocolError{ErrSocks4Rejected, resp[1]}
+	}
+	return &Addr{
+		IP:		net.IP(append([]byte(nil), resp[4:8]...)),
+		Port:	int(binary.BigEndian.Uint16(resp[2:4])),
+	}, nil
+}
+
+// socks5Unsupported reports whether err means the proxy did not accept a
+// SOCKS5 greeting at all, as a SOCKS4-only proxy would.
+func socks5Unsupported(err *HandshakeError) bool {
+	if err.Stage != StageMethodNegotiation {
+		return false
+	}
+	return errors.Is(err, ErrNotSocks5) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,266 @@
+package socks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// socks4Request is a request received by a socks4Peer.
+type socks4Request struct {
+	cmd		Command
+	port	int
+	ip		net.IP
+	user	string
+	name	string
+}
+
+// socks4Peer is a scripted SOCKS4 proxy.  It answers each request with code,
+// and then echoes back what it receives if the request was granted.
+type socks4Peer struct {
+	code	byte
+	version	byte	// of the reply
+	// greeting is sent in answer to a SOCKS5 greeting, before closing the
+	// connection; nil closes it straight away, like a SOCKS4-only proxy
+	greeting	[]byte
+
+	socks5	atomic.Int32	// number of SOCKS5 greetings received
+	reqs	chan *socks4Request
+}
+
+// start runs p on a loopback port until the end of the test, and returns the
+// address to reach it at.
+func (p *socks4Peer) start(t *testing.T) string {
+	t.Helper()
+	p.reqs = make(chan *socks4Request, 10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (p *socks4Peer) serve(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	ver, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	if ver == socks5Version {
+		p.socks5.Add(1)
+		if p.greeting != nil {
+			c.Write(p.greeting)
+		}
+		return
+	}
+	var hdr [7]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+	req := &socks4Request{
+		cmd:	Command(hdr[0]),
+		port:	int(binary.BigEndian.Uint16(hdr[1:3])),
+		ip:		net.IP(hdr[3:7]),
+	}
+	req.user, err = r.ReadString(0)
+	if err != nil {
+		return
+	}
+	req.user = req.user[:len(req.user)-1]
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		req.name, err = r.ReadString(0)
+		if err != nil {
+			return
+		}
+		req.name = req.name[:len(req.name)-1]
+	}
+	p.reqs <- req
+
+	reply := []byte{p.version, p.code, 0x04, 0x38, 192, 0, 2, 1}
+	_, err = c.Write(reply)
+	if err != nil || p.code != socks4RequestGranted {
+		return
+	}
+	io.Copy(c, r)
+}
+
+func TestSocks4(t *testing.T) {
+	p := &socks4Peer{code: socks4RequestGranted}
+	d := &Dialer{
+		ProxyAddr:	p.start(t),
+		Version:	VersionSocks4,
+		Timeout:	5 * time.Second,
+		Auth:		&Auth{User: "alice", Password: "unused"},
+		Resolver:	staticResolver{"echo.test": {net.IPv4(192, 0, 2, 7)}},
+	}
+	conn, err := d.Dial("tcp", "echo.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	// the name is resolved locally, to an IPv4 address
+	req := <-p.reqs
+	if req.cmd != CommandConnect || req.port != 80 || !req.ip.Equal(net.IPv4(192, 0, 2, 7)) || req.user != "alice" || req.name != "" {
+		t.Errorf("proxy got %+v, want CONNECT to 192.0.2.7:80 for alice", req)
+	}
+	if bound := conn.(*Conn).BoundAddr().String(); bound != "192.0.2.1:1080" {
+		t.Errorf("BoundAddr() = %s, want 192.0.2.1:1080", bound)
+	}
+
+	_, err = d.Dial("tcp", "[2001:db8::1]:80")
+	if !errors.Is(err, ErrSocks4Addr) {
+		t.Errorf("dial to an IPv6 address: got %v, want %v", err, ErrSocks4Addr)
+	}
+	_, err = d.Dial("udp", "192.0.2.7:53")
+	if err == nil {
+		t.Error("UDP dial through a SOCKS4 proxy succeeded")
+	}
+}
+
+func TestSocks4a(t *testing.T) {
+	// some proxies send 4 as the reply version
+	p := &socks4Peer{code: socks4RequestGranted, version: socks4Version}
+	d := &Dialer{
+		ProxyAddr:	p.start(t),
+		Version:	VersionSocks4a,
+		Timeout:	5 * time.Second,
+	}
+	conn, err := d.Dial("tcp", "echo.test:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	req := <-p.reqs
+	if req.cmd != CommandConnect || req.port != 443 || !req.ip.Equal(net.IPv4(0, 0, 0, 1)) || req.user != "" || req.name != "echo.test" {
+		t.Errorf("proxy got %+v, want CONNECT to echo.test:443", req)
+	}
+
+	// IPv4 addresses are still sent as such
+	conn, err = d.Dial("tcp", "192.0.2.7:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	req = <-p.reqs
+	if !req.ip.Equal(net.IPv4(192, 0, 2, 7)) || req.name != "" {
+		t.Errorf("proxy got %+v, want CONNECT to 192.0.2.7:443", req)
+	}
+
+	d.Auth = &Auth{User: "nul\x00"}
+	_, err = d.Dial("tcp", "192.0.2.7:443")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("user ID with a NUL byte: got %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestSocks4Rejections(t *testing.T) {
+	tests := []struct {
+		code	byte
+		err		error
+	}{
+		{socks4RequestRejected, ErrSocks4Rejected},
+		{socks4NoIdentd, ErrSocks4Ident},
+		{socks4IdentdMismatch, ErrSocks4Ident},
+		{0x00, ErrSocks4Rejected},
+	}
+	for _, tt := range tests {
+		p := &socks4Peer{code: tt.code}
+		d := &Dialer{
+			ProxyAddr:	p.start(t),
+			Version:	VersionSocks4a,
+			Timeout:	5 * time.Second,
+		}
+		_, err := d.Dial("tcp", "echo.test:80")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("reply %d: got %v, want %v", tt.code, err, tt.err)
+			continue
+		}
+		var herr *HandshakeError
+		if !errors.As(err, &herr) || herr.Stage != StageConnect {
+			t.Errorf("reply %d: got %#v, want a HandshakeError in StageConnect", tt.code, err)
+		}
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Value != tt.code {
+			t.Errorf("reply %d: got %v, want the code reported", tt.code, err)
+		}
+	}
+
+	// any reply version but 0 and 4 is refused
+	p := &socks4Peer{code: socks4RequestGranted, version: socks5Version}
+	d := &Dialer{ProxyAddr: p.start(t), Version: VersionSocks4a, Timeout: 5 * time.Second}
+	_, err := d.Dial("tcp", "echo.test:80")
+	if !errors.Is(err, ErrSocks4ReplyVersion) {
+		t.Errorf("reply version 5: got %v, want %v", err, ErrSocks4ReplyVersion)
+	}
+}
+
+func TestVersionAuto(t *testing.T) {
+	tests := []struct {
+		name		string
+		version		Version
+		greeting	[]byte
+		fallback	bool
+	}{
+		// a SOCKS4-only proxy hangs up on the greeting...
+		{"closed", VersionAuto, nil, true},
+		// ...or answers it as a malformed SOCKS4 request
+		{"socks4 reply", VersionAuto, []byte{0x00, socks4RequestRejected}, true},
+		{"closed, SOCKS5 only", VersionSocks5, nil, false},
+		// a SOCKS5 proxy which refuses the methods offered is not retried
+		{"no acceptable methods", VersionAuto, []byte{socks5Version, socks5NoAcceptableMethods}, false},
+	}
+	for _, tt := range tests {
+		p := &socks4Peer{code: socks4RequestGranted, greeting: tt.greeting}
+		d := &Dialer{
+			ProxyAddr:	p.start(t),
+			Version:	tt.version,
+			Timeout:	5 * time.Second,
+		}
+		conn, err := d.Dial("tcp", "echo.test:80")
+		if n := p.socks5.Load(); n != 1 {
+			t.Errorf("%s: proxy got %d SOCKS5 greetings, want 1", tt.name, n)
+		}
+		if !tt.fallback {
+			var herr *HandshakeError
+			if !errors.As(err, &herr) || herr.Stage != StageMethodNegotiation {
+				t.Errorf("%s: got %v, want the SOCKS5 method negotiation to fail", tt.name, err)
+			}
+			if len(p.reqs) != 0 {
+				t.Errorf("%s: fell back to SOCKS4", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		checkEcho(t, conn)
+		conn.Close()
+		// the fallback is to SOCKS4a, which leaves the name to the proxy
+		if req := <-p.reqs; req.name != "echo.test" {
+			t.Errorf("%s: proxy got %+v, want a SOCKS4a request for echo.test", tt.name, req)
+		}
+	}
+}
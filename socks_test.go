@@ -0,0 +1,96 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// cannedConn is a connection to a proxy which plays back pre-encoded answers
+// and discards whatever is written to it, for benchmarking the client side of
+// the handshake without any I/O.
+type cannedConn struct {
+	net.Conn	// nil; only the methods below are used
+	answers		[]byte
+	unread		[]byte
+	writes		int
+}
+
+func (c *cannedConn) Read(b []byte) (int, error) {
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *cannedConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func (c *cannedConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (c *cannedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func (c *cannedConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *cannedConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *cannedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// cannedAnswers returns a successful method selection and reply.
+func cannedAnswers() []byte {
+	sel, _ := (&MethodSelection{Method: 0x00}).Marshal()
+	reply, _ := (&Reply{Code: ReplySucceeded, Bound: &Addr{IP: net.IPv4(10, 0, 0, 1), Port: 54321}}).Marshal()
+	return append(sel, reply...)
+}
+
+// benchmarkHandshake measures socks5Handshake alone, for a CONNECT to a host
+// name.
+func benchmarkHandshake(b *testing.B, pipeline bool) {
+	conn := &cannedConn{answers: cannedAnswers()}
+	dst := &Addr{Name: "example.com", Port: 443}
+	b.ReportAllocs()
+	for b.Loop() {
+		conn.unread = conn.answers
+		_, _, _, err := socks5Handshake(conn, CommandConnect, dst, defaultAuthMethods, pipeline, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	benchmarkHandshake(b, false)
+}
+
+func BenchmarkHandshakePipelined(b *testing.B) {
+	benchmarkHandshake(b, true)
+}
+
+// BenchmarkClient measures Dialer.Client as a whole, which adds parsing the
+// target, the dial ID and the returned *Conn to the handshake.
+func BenchmarkClient(b *testing.B) {
+	conn := &cannedConn{answers: cannedAnswers()}
+	d := &Dialer{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for b.Loop() {
+		conn.unread = conn.answers
+		_, err := d.Client(ctx, conn, "example.com:443")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Package sockstest provides a scriptable SOCKS5 server for unit tests of code
+// which connects through a proxy using package socks.  Rather than connecting
+// anywhere, the server answers each step of the handshake as its Script says,
+// which makes failures such as refused methods, failed authentication,
+// unfavourable reply codes and slow proxies easy to reproduce.  It can listen
+// on localhost, or serve connections made over net.Pipe without touching the
+// network at all.
+package sockstest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johto/socks5"
+)
+
+// Authentication methods, for Script.Method.
+const (
+	MethodNoAuthentication	byte = 0x00
+	MethodUsernamePassword	byte = 0x02
+	MethodNoAcceptable		byte = 0xFF
+)
+
+// ErrClosed is returned by Server.DialContext once the server is closed.
+var ErrClosed = errors.New("sockstest: server closed")
+
+// A Script says how a Server answers its clients.  The zero value selects
+// NoAuthentication, grants every request and then echoes back whatever the
+// client sends.
+type Script struct {
+	// Method is the authentication method sent in reply to any greeting,
+	// whether or not the client offered it.  With MethodNoAcceptable, the
+	// connection is closed right after.  With MethodUsernamePassword, the
+	// client has to authenticate with User and Password.  Any other method
+	// is followed directly by the request, without sub-negotiation.
+	Method		byte
+	User		string
+	Password	string
+
+	// MethodDelay and ReplyDelay are waited for before sending the method
+	// selection and the reply to the request respectively, which is handy
+	// for testing timeouts.  Closing the Server cuts them short.
+	MethodDelay	time.Duration
+	ReplyDelay	time.Duration
+
+	// Reply is the code of the reply sent to the request.  Unless it is
+	// socks.ReplySucceeded, the connection is closed after the reply.
+	Reply	socks.ReplyCode
+
+	// Bound is the address sent in the reply.  If nil, it is 0.0.0.0:0.
+	Bound	*socks.Addr
+
+	// Handler, if not nil, is called with the connection and the request once
+	// a request has been granted, and the connection is closed when it
+	// returns.  If nil, everything the client sends is echoed back.
+	Handler	func(conn net.Conn, req *socks.Request)
+}
+
+// A Server runs a Script for every connection made to it, and records the
+// requests it receives.
+type Server struct {
+	// Addr is the address the server listens on, or "" for servers created
+	// with NewPipeServer.
+	Addr	string
+
+	script		*Script
+	listener	net.Listener
+	done		chan struct{}
+	wg			sync.WaitGroup
+
+	mu			sync.Mutex
+	closed		bool
+	conns		map[net.Conn]struct{}
+	requests	[]*socks.Request
+}
+
+// NewServer returns a Server running script, or the zero Script if nil,
+// listening on a port of the IPv4 loopback address.  It panics if it cannot
+// listen, as tests have little use for the error.  The caller should Close it
+// when done.
+func NewServer(script *Script) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("sockstest: failed to listen: " + err.Error())
+	}
+	s := newServer(script)
+	s.Addr = l.Addr().String()
+	s.listener = l
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// NewPipeServer returns a Server running script which does not listen on
+// anything: connections to it are only made through its DialContext method,
+// over net.Pipe.
+func NewPipeServer(script *Script) *Server {
+	return newServer(script)
+}
+
+func newServer(script *Script) *Server {
+	if script == nil {
+		script = &Script{}
+	}
+	return &Server{
+		script:	script,
+		done:	make(chan struct{}),
+		conns:	make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.start(conn)
+	}
+}
+
+// start serves conn in a new goroutine, unless the server is closed.
+func (s *Server) start(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.script.serveConn(conn, s.done, s.record)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+func (s *Server) record(req *socks.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+}
+
+// DialContext returns one end of a net.Pipe, and serves the other.  The
+// network and address are ignored.  Together with Dialer, this lets tests
+// run without the network.  The server keeps reading from the pipe while it
+// writes, so that clients which send more than one message at a time, such
+// as a Dialer with Pipeline set, do not block it.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	if !s.start(newDrainConn(server)) {
+		client.Close()
+		return nil, ErrClosed
+	}
+	return client, nil
+}
+
+// drainConn is the server end of a net.Pipe, which reads everything the client
+// writes into a buffer as soon as it arrives.  Unlike with TCP, a Write to a
+// pipe blocks until the other end has read all of it, so a server answering
+// the first of several messages sent in one Write would otherwise deadlock
+// with the client.  Read deadlines set on a drainConn have no effect.
+type drainConn struct {
+	net.Conn
+
+	mu		sync.Mutex
+	cond	sync.Cond
+	buf		[]byte
+	err		error	// from the pipe, once buf is drained
+}
+
+func newDrainConn(conn net.Conn) *drainConn {
+	c := &drainConn{Conn: conn}
+	c.cond.L = &c.mu
+	go c.drain()
+	return c
+}
+
+func (c *drainConn) drain() {
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Conn.Read(b)
+		c.mu.Lock()
+		c.buf = append(c.buf, b[:n]...)
+		c.err = err
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *drainConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		return 0, c.err
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Dialer returns a socks.Dialer which connects to the server: through Addr
+// for servers created with NewServer, or over net.Pipe using the server's
+// DialContext as Forward for those created with NewPipeServer.
+func (s *Server) Dialer() *socks.Dialer {
+	if s.listener != nil {
+		return &socks.Dialer{ProxyAddr: s.Addr}
+	}
+	return &socks.Dialer{ProxyAddr: "sockstest.invalid:1080", Forward: s}
+}
+
+// Requests returns the requests the server has received so far, in order.
+func (s *Server) Requests() []*socks.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*socks.Request(nil), s.requests...)
+}
+
+// Close stops the server, closes all connections to it, and waits for their
+// goroutines to return.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// ServeConn runs the script on conn, an accepted connection from a client,
+// and closes conn when done.  It returns the request received, if any.  The
+// error is that of the handshake; socks.ErrMethodNegotiation and
+// socks.ErrAuthFailed mean the script turned the client away as told.
+func (sc *Script) ServeConn(conn net.Conn) (*socks.Request, error) {
+	var req *socks.Request
+	err := sc.serveConn(conn, nil, func(r *socks.Request) { req = r })
+	return req, err
+}
+
+func (sc *Script) serveConn(conn net.Conn, done <-chan struct{}, record func(*socks.Request)) error {
+	defer conn.Close()
+
+	var greeting socks.Greeting
+	_, err := greeting.ReadFrom(conn)
+	if err != nil {
+		return err
+	}
+	if !sleep(sc.MethodDelay, done) {
+		return ErrClosed
+	}
+	_, err = (&socks.MethodSelection{Method: sc.Method}).WriteTo(conn)
+	if err != nil {
+		return err
+	}
+	switch sc.Method {
+		case MethodNoAcceptable:
+			return socks.ErrMethodNegotiation
+		case MethodUsernamePassword:
+			err = sc.authenticate(conn)
+			if err != nil {
+				return err
+			}
+	}
+
+	req := new(socks.Request)
+	_, err = req.ReadFrom(conn)
+	if err != nil {
+		return err
+	}
+	record(req)
+	if !sleep(sc.ReplyDelay, done) {
+		return ErrClosed
+	}
+	_, err = (&socks.Reply{Code: sc.Reply, Bound: sc.Bound}).WriteTo(conn)
+	if err != nil || sc.Reply != socks.ReplySucceeded {
+		return err
+	}
+
+	if sc.Handler != nil {
+		sc.Handler(conn, req)
+	} else {
+		io.Copy(conn, conn)
+	}
+	return nil
+}
+
+// authenticate performs the server side of the username/password
+// sub-negotiation, as described in RFC 1929.
+func (sc *Script) authenticate(conn net.Conn) error {
+	var buf [2]byte
+	_, err := io.ReadFull(conn, buf[:])
+	if err != nil {
+		return err
+	}
+	if buf[0] != 0x01 {
+		return &socks.ProtocolError{Err: socks.ErrAuthVersion, Value: buf[0]}
+	}
+	user := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return err
+	}
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+
+	ok := string(user) == sc.User && string(password) == sc.Password
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	_, err = conn.Write([]byte{0x01, status})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return socks.ErrAuthFailed
+	}
+	return nil
+}
+
+// sleep waits for d, and reports whether it did so before done was closed.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+		case <-t.C:
+			return true
+		case <-done:
+			return false
+	}
+}
@@ -0,0 +1,224 @@
+package sockstest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/johto/socks5"
+)
+
+// forEachServer runs f with a Server running script, once for each kind of
+// Server.
+func forEachServer(t *testing.T, script *Script, f func(t *testing.T, s *Server)) {
+	for _, kind := range []struct {
+		name	string
+		new		func(*Script) *Server
+	}{
+		{"NewServer", NewServer},
+		{"NewPipeServer", NewPipeServer},
+	} {
+		t.Run(kind.name, func(t *testing.T) {
+			s := kind.new(script)
+			defer s.Close()
+			f(t, s)
+		})
+	}
+}
+
+// checkEcho writes a message to conn and checks that it comes back.
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("hello, world")
+	_, err := conn.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Fatalf("got %q back, want %q", got, msg)
+	}
+}
+
+func TestDefaultScript(t *testing.T) {
+	test := func(t *testing.T, s *Server, pipeline bool) {
+		d := s.Dialer()
+		d.Pipeline = pipeline
+		d.Timeout = 5 * time.Second
+		conn, err := d.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		checkEcho(t, conn)
+		if bound := conn.(*socks.Conn).BoundAddr().String(); bound != "0.0.0.0:0" {
+			t.Errorf("BoundAddr() = %s, want 0.0.0.0:0", bound)
+		}
+
+		reqs := s.Requests()
+		if len(reqs) != 1 || reqs[0].Command != socks.CommandConnect || reqs[0].Dst.String() != "example.com:443" {
+			t.Errorf("Requests() = %v, want a single CONNECT to example.com:443", reqs)
+		}
+	}
+	forEachServer(t, nil, func(t *testing.T, s *Server) {
+		test(t, s, false)
+	})
+	t.Run("Pipeline", func(t *testing.T) {
+		forEachServer(t, nil, func(t *testing.T, s *Server) {
+			test(t, s, true)
+		})
+	})
+}
+
+func TestMethodNoAcceptable(t *testing.T) {
+	forEachServer(t, &Script{Method: MethodNoAcceptable}, func(t *testing.T, s *Server) {
+		_, err := s.Dialer().Dial("tcp", "example.com:80")
+		if !errors.Is(err, socks.ErrMethodNegotiation) {
+			t.Errorf("got %v, want ErrMethodNegotiation", err)
+		}
+		if reqs := s.Requests(); len(reqs) != 0 {
+			t.Errorf("Requests() = %v, want none", reqs)
+		}
+	})
+}
+
+func TestUsernamePassword(t *testing.T) {
+	script := &Script{Method: MethodUsernamePassword, User: "user", Password: "secret"}
+	forEachServer(t, script, func(t *testing.T, s *Server) {
+		d := s.Dialer()
+		d.Auth = &socks.Auth{User: "user", Password: "secret"}
+		conn, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, conn)
+		conn.Close()
+
+		d.Auth.Password = "wrong"
+		_, err = d.Dial("tcp", "example.com:80")
+		var herr *socks.HandshakeError
+		if !errors.As(err, &herr) || herr.Stage != socks.StageAuth || !errors.Is(err, socks.ErrAuthFailed) {
+			t.Errorf("got %v, want ErrAuthFailed at the auth stage", err)
+		}
+		if reqs := s.Requests(); len(reqs) != 1 {
+			t.Errorf("Requests() = %v, want only the authenticated one", reqs)
+		}
+	})
+}
+
+func TestReply(t *testing.T) {
+	forEachServer(t, &Script{Reply: socks.ReplyHostUnreachable}, func(t *testing.T, s *Server) {
+		_, err := s.Dialer().Dial("tcp", "example.com:80")
+		var herr *socks.HandshakeError
+		if !errors.As(err, &herr) || herr.ReplyCode != socks.ReplyHostUnreachable {
+			t.Errorf("got %v, want ReplyHostUnreachable", err)
+		}
+		if reqs := s.Requests(); len(reqs) != 1 {
+			t.Errorf("Requests() = %v, want the refused request", reqs)
+		}
+	})
+
+	bound := &socks.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	forEachServer(t, &Script{Bound: bound}, func(t *testing.T, s *Server) {
+		conn, err := s.Dialer().Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := conn.(*socks.Conn).BoundAddr().String(); got != bound.String() {
+			t.Errorf("BoundAddr() = %s, want %s", got, bound)
+		}
+	})
+}
+
+func TestHandler(t *testing.T) {
+	script := &Script{
+		Handler: func(conn net.Conn, req *socks.Request) {
+			io.WriteString(conn, "hello "+req.Dst.String())
+		},
+	}
+	forEachServer(t, script, func(t *testing.T, s *Server) {
+		conn, err := s.Dialer().Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello example.com:80" {
+			t.Errorf("got %q, want the Handler's greeting", got)
+		}
+	})
+}
+
+func TestDelays(t *testing.T) {
+	tests := []struct {
+		script	*Script
+		stage	socks.Stage
+	}{
+		{&Script{MethodDelay: time.Minute}, socks.StageMethodNegotiation},
+		{&Script{ReplyDelay: time.Minute}, socks.StageConnect},
+	}
+	for _, tt := range tests {
+		forEachServer(t, tt.script, func(t *testing.T, s *Server) {
+			d := s.Dialer()
+			d.HandshakeTimeout = 50 * time.Millisecond
+			start := time.Now()
+			_, err := d.Dial("tcp", "example.com:80")
+			var herr *socks.HandshakeError
+			if !errors.As(err, &herr) || herr.Stage != tt.stage || !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("got %v, want a timeout at stage %v", err, tt.stage)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("dial took %v, want HandshakeTimeout to cut it short", elapsed)
+			}
+		})
+	}
+
+	// Close cuts the delays short
+	s := NewPipeServer(&Script{MethodDelay: time.Minute})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+	}()
+	start := time.Now()
+	_, err := s.Dialer().Dial("tcp", "example.com:80")
+	if err == nil {
+		t.Error("dial succeeded despite Close")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dial took %v, want Close to cut the delay short", elapsed)
+	}
+	_, err = s.DialContext(context.Background(), "tcp", "")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("DialContext after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	client, server := net.Pipe()
+	script := &Script{Reply: socks.ReplyNotAllowed}
+	done := make(chan *socks.Request, 1)
+	go func() {
+		req, _ := script.ServeConn(server)
+		done <- req
+	}()
+	_, err := (&socks.Dialer{}).Client(context.Background(), client, "example.com:80")
+	if !errors.Is(err, socks.ReplyNotAllowed) {
+		t.Errorf("got %v, want ReplyNotAllowed", err)
+	}
+	client.Close()
+	if req := <-done; req == nil || req.Dst.String() != "example.com:80" {
+		t.Errorf("ServeConn returned %v, want the request for example.com:80", req)
+	}
+}
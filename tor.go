@@ -0,0 +1,41 @@
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// ResolveHost asks the proxy to look up host, using the RESOLVE extension
+// supported by Tor, and returns the address it found.  Unlike resolving host
+// names locally, this does not leak the lookup to the local DNS servers.  The
+// name is always sent to the proxy, regardless of d.Resolve.  Any error
+// returned is a *HandshakeError.
+func (d *Dialer) ResolveHost(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	conn, err := d.dial(ctx, "tcp", CommandResolve, &Addr{Name: host})
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return conn.boundAddr.IP, nil
+}
+
+// ResolvePtr asks the proxy for the host name of ip, using the RESOLVE_PTR
+// extension supported by Tor.  Any error returned is a *HandshakeError.
+func (d *Dialer) ResolvePtr(ctx context.Context, ip net.IP) (string, error) {
+	conn, err := d.dial(ctx, "tcp", CommandResolvePtr, &Addr{IP: ip})
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	if bound := conn.boundAddr; bound.IP != nil {
+		atyp := socks5IPv6Addr
+		if bound.IP.To4() != nil {
+			atyp = socks5IPv4Addr
+		}
+		return "", newHandshakeError(StageConnect, conn.proxy, ip.String(), &ProtocolError{ErrAddrType, atyp}).withID(conn.id)
+	}
+	return conn.boundAddr.Name, nil
+}
@@ -0,0 +1,147 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startResolver runs a scripted proxy which answers every request with a
+// successful reply carrying the address answers maps the request's target
+// to, and records the requests.
+func startResolver(t *testing.T, answers map[string]*Addr) (string, <-chan *Request) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	reqs := make(chan *Request, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				var g Greeting
+				if _, err := g.ReadFrom(c); err != nil {
+					return
+				}
+				c.Write([]byte{socks5Version, 0x00})
+				req := new(Request)
+				if _, err := req.ReadFrom(c); err != nil {
+					return
+				}
+				reqs <- req
+				reply := &Reply{Code: ReplySucceeded, Bound: answers[req.Dst.String()]}
+				if reply.Bound == nil {
+					reply.Code = ReplyHostUnreachable
+				}
+				b, err := reply.Marshal()
+				if err == nil {
+					c.Write(b)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), reqs
+}
+
+func TestResolveHost(t *testing.T) {
+	proxy, reqs := startResolver(t, map[string]*Addr{
+		"onion.example:0":			{IP: net.IPv4(192, 0, 2, 1)},
+		"xn--bcher-kva.example:0":	{IP: net.ParseIP("2001:db8::1")},
+		"name.example:0":			{Name: "other.example"},
+	})
+	d := &Dialer{ProxyAddr: proxy, Timeout: 5 * time.Second, Resolve: ResolveLocal}
+	ctx := context.Background()
+
+	// the name is sent to the proxy even with ResolveLocal
+	ip, err := d.ResolveHost(ctx, "onion.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got %v, want 192.0.2.1", ip)
+	}
+	if req := <-reqs; req.Command != CommandResolve || req.Dst.Name != "onion.example" {
+		t.Errorf("proxy got %v for %v, want RESOLVE for onion.example", req.Command, req.Dst)
+	}
+
+	ip, err = d.ResolveHost(ctx, "bücher.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got %v, want 2001:db8::1", ip)
+	}
+	<-reqs
+
+	// IP addresses need no lookup
+	ip, err = d.ResolveHost(ctx, "192.0.2.9")
+	if err != nil || !ip.Equal(net.IPv4(192, 0, 2, 9)) {
+		t.Errorf("got %v, %v for an IP address", ip, err)
+	}
+	if len(reqs) != 0 {
+		t.Error("proxy asked to resolve an IP address")
+	}
+
+	// a name is no answer to RESOLVE
+	_, err = d.ResolveHost(ctx, "name.example")
+	if !errors.Is(err, ErrAddrType) {
+		t.Errorf("name in reply: got %v, want %v", err, ErrAddrType)
+	}
+	<-reqs
+
+	_, err = d.ResolveHost(ctx, "unknown.example")
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || !errors.Is(err, ReplyHostUnreachable) || herr.Target != "unknown.example:0" {
+		t.Errorf("failed lookup: got %v, want ReplyHostUnreachable", err)
+	}
+}
+
+func TestResolvePtr(t *testing.T) {
+	proxy, reqs := startResolver(t, map[string]*Addr{
+		"192.0.2.1:0":		{Name: "host.example"},
+		"[2001:db8::1]:0":	{Name: "v6.example"},
+		"192.0.2.2:0":		{IP: net.IPv4(192, 0, 2, 2)},
+	})
+	d := &Dialer{ProxyAddr: proxy, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	name, err := d.ResolvePtr(ctx, net.IPv4(192, 0, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "host.example" {
+		t.Errorf("got %q, want host.example", name)
+	}
+	if req := <-reqs; req.Command != CommandResolvePtr || !req.Dst.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("proxy got %v for %v, want RESOLVE_PTR for 192.0.2.1", req.Command, req.Dst)
+	}
+
+	name, err = d.ResolvePtr(ctx, net.ParseIP("2001:db8::1"))
+	if err != nil || name != "v6.example" {
+		t.Errorf("got %q, %v, want v6.example", name, err)
+	}
+	<-reqs
+
+	// an IP address is no answer to RESOLVE_PTR
+	_, err = d.ResolvePtr(WithDialID(ctx, "ptr-1"), net.IPv4(192, 0, 2, 2))
+	var herr *HandshakeError
+	var perr *ProtocolError
+	if !errors.As(err, &herr) || herr.ID != "ptr-1" || !errors.As(err, &perr) || perr.Err != ErrAddrType || perr.Value != socks5IPv4Addr {
+		t.Errorf("IP address in reply: got %v, want %v for an IPv4 address", err, ErrAddrType)
+	}
+	<-reqs
+
+	_, err = d.ResolvePtr(ctx, net.IPv4(192, 0, 2, 3))
+	if !errors.Is(err, ReplyHostUnreachable) {
+		t.Errorf("failed lookup: got %v, want ReplyHostUnreachable", err)
+	}
+}
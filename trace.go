@@ -0,0 +1,197 @@
+package socks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientTrace is a set of hooks called while a Dialer connects through a
+// proxy, in the spirit of net/http/httptrace.  It is attached to the context
+// passed to DialContext, Bind, ListenPacket and the other methods of Dialer
+// taking a context, using WithClientTrace.  Any of the hooks may be nil.  The
+// hooks for individual messages are only called for SOCKS5; Raw covers SOCKS4
+// as well.  When a Dialer reaches its proxy through another Dialer, as with
+// Chain, the hooks after DialStart are called for each hop, nested: the
+// ConnectStart of the last hop comes first, and its ConnectDone only follows
+// the handshakes with the hops before it.  The hooks are called
+// synchronously, and must not retain the slices passed to them.
+type ClientTrace struct {
+	// DialStart is called first, with the ID of the dial (see WithDialID)
+	// and the target as given.  It is called once per dial, however many
+	// proxies are tried and however many hops it goes through, so unless
+	// the ClientTrace is shared by concurrent dials, the calls to the other
+	// hooks since DialStart all belong to the dial with that ID.
+	DialStart	func(id, target string)
+
+	// ConnectStart is called before connecting to a proxy, and ConnectDone
+	// once the connection, including the TLS handshake if any, is made or
+	// has failed.  With fallback proxies, they are called for each one
+	// tried.
+	ConnectStart	func(proxy string)
+	ConnectDone		func(proxy string, err error)
+
+	// WroteGreeting is called after sending the greeting offering methods.
+	WroteGreeting	func(methods []byte, err error)
+
+	// GotMethodSelection is called after reading the method the proxy
+	// selected.
+	GotMethodSelection	func(method byte, err error)
+
+	// WroteRequest is called after sending a request.
+	WroteRequest	func(cmd Command, dst *Addr, err error)
+
+	// GotReply is called after reading a reply, including the second reply
+	// to a BIND request.  If the proxy refused the request, code is what it
+	// sent, and err is the corresponding ReplyCode.
+	GotReply	func(code ReplyCode, bound *Addr, err error)
+
+	// Raw, if not nil, is called with all bytes written to (if written is
+	// true) and read from the proxy during the handshake, as they pass.
+	// Once the handshake is complete, Raw is no longer called.  Note that
+	// this includes any credentials sent to the proxy.
+	Raw		func(written bool, b []byte)
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace returns a new context based on ctx, which makes the Dialer
+// methods called with it report to trace.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace attached to ctx, or nil if there
+// is none.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+type dialIDKey struct{}
+
+// WithDialID returns a new context based on ctx, which makes the dials made
+// with it use id as their dial ID.  The dial ID of a dial appears in the
+// *HandshakeError it may fail with, in DialStats, and in the DialStart hook
+// of ClientTrace, and is available from the returned Conn, so that retries
+// and failovers can be told apart in aggregated logs.  Without WithDialID,
+// each dial gets an ID of its own, unique within the process.
+func WithDialID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, dialIDKey{}, id)
+}
+
+// dialID returns the dial ID attached to ctx with WithDialID, or a new one.
+func dialID(ctx context.Context) string {
+	if id, ok := ctx.Value(dialIDKey{}).(string); ok {
+		return id
+	}
+	return dialIDPrefix() + "-" + strconv.FormatUint(dialIDCounter.Add(1), 10)
+}
+
+// dialIDPrefix distinguishes the dial IDs generated by this process from
+// those of other processes.
+var dialIDPrefix = sync.OnceValue(func() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+})
+
+var dialIDCounter atomic.Uint64
+
+// hopKey is the key of the dial ID attached to the context passed to a
+// Dialer's Forward, so that a Dialer reached that way as a hop of a chain
+// carries on with the same dial instead of starting one of its own.
+type hopKey struct{}
+
+// The methods below call the corresponding hook if both t and the hook are
+// not nil.
+
+func (t *ClientTrace) dialStart(id, target string) {
+	if t != nil && t.DialStart != nil {
+		t.DialStart(id, target)
+	}
+}
+
+func (t *ClientTrace) connectStart(proxy string) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(proxy)
+	}
+}
+
+func (t *ClientTrace) connectDone(proxy string, err error) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(proxy, err)
+	}
+}
+
+func (t *ClientTrace) wroteGreeting(methods []byte, err error) {
+	if t != nil && t.WroteGreeting != nil {
+		t.WroteGreeting(methods, err)
+	}
+}
+
+func (t *ClientTrace) gotMethodSelection(method byte, err error) {
+	if t != nil && t.GotMethodSelection != nil {
+		t.GotMethodSelection(method, err)
+	}
+}
+
+func (t *ClientTrace) wroteRequest(cmd Command, dst *Addr, err error) {
+	if t != nil && t.WroteRequest != nil {
+		t.WroteRequest(cmd, dst, err)
+	}
+}
+
+func (t *ClientTrace) gotReply(code ReplyCode, bound *Addr, err error) {
+	if t != nil && t.GotReply != nil {
+		t.GotReply(code, bound, err)
+	}
+}
+
+// traceRaw returns a connection which reports all traffic on conn to
+// t.Raw until the returned function is called, or conn itself if there is
+// nothing to report to.  The returned function also returns the connection
+// to use afterwards: if hsConn is the wrapper, that is conn.
+func (t *ClientTrace) traceRaw(conn net.Conn) (net.Conn, func(hsConn net.Conn) net.Conn) {
+	if t == nil || t.Raw == nil {
+		return conn, func(hsConn net.Conn) net.Conn { return hsConn }
+	}
+	rc := &rawTraceConn{Conn: conn, raw: t.Raw}
+	return rc, func(hsConn net.Conn) net.Conn {
+		rc.done.Store(true)
+		if hsConn == net.Conn(rc) {
+			return conn
+		}
+		// an authentication method wrapped the connection, so the wrapper
+		// has to stay
+		return hsConn
+	}
+}
+
+// rawTraceConn passes the bytes read from and written to a connection to a
+// ClientTrace's Raw hook.
+type rawTraceConn struct {
+	net.Conn
+	raw		func(written bool, b []byte)
+	done	atomic.Bool
+}
+
+func (c *rawTraceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.done.Load() {
+		c.raw(false, p[:n])
+	}
+	return n, err
+}
+
+func (c *rawTraceConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 && !c.done.Load() {
+		c.raw(true, p[:n])
+	}
+	return n, err
+}
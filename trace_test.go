@@ -0,0 +1,139 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialID(t *testing.T) {
+	echo := startEcho(t)
+	// nothing listens on a port of a listener closed right away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	var ids []string
+	trace := &ClientTrace{
+		DialStart: func(id, target string) { ids = append(ids, id) },
+	}
+	ctx := WithClientTrace(context.Background(), trace)
+	d := &Dialer{
+		ProxyAddr:			dead,
+		FallbackProxyAddrs:	[]string{startServer(t, &Server{})},
+		Timeout:			5 * time.Second,
+	}
+	conn, err := d.DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(ids) != 1 || ids[0] == "" {
+		t.Fatalf("DialStart called with %q, want a single ID despite the fallback", ids)
+	}
+	if got := conn.(*Conn).DialID(); got != ids[0] {
+		t.Errorf("DialID() = %q, want %q", got, ids[0])
+	}
+
+	conn2, err := d.DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2.Close()
+	if len(ids) != 2 || ids[1] == ids[0] {
+		t.Errorf("second dial got ID %q, want one different from %q", ids[1:], ids[0])
+	}
+
+	var retried []string
+	d.Retry = func(err *HandshakeError) bool {
+		retried = append(retried, err.ID)
+		return true
+	}
+	d.FallbackProxyAddrs = []string{dead}
+	_, err = d.DialContext(WithDialID(ctx, "req-42"), "tcp", echo)
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.ID != "req-42" {
+		t.Fatalf("got %v, want a *HandshakeError with ID req-42", err)
+	}
+	if !strings.Contains(err.Error(), "(dial req-42)") {
+		t.Errorf("error %q does not mention the dial ID", err)
+	}
+	if len(retried) != 1 || retried[0] != "req-42" {
+		t.Errorf("Retry saw IDs %q, want [req-42]", retried)
+	}
+}
+
+func TestChain(t *testing.T) {
+	echo := startEcho(t)
+	var mu sync.Mutex
+	var requests []string
+	rules := func(name string) Rules {
+		return RuleFunc(func(client net.Addr, dst *Addr, cmd Command) bool {
+			mu.Lock()
+			requests = append(requests, name+" "+dst.String())
+			mu.Unlock()
+			return true
+		})
+	}
+	first := startServer(t, &Server{Rules: rules("first")})
+	second := startServer(t, &Server{Rules: rules("second"), Credentials: map[string]string{"user": "secret"}})
+
+	var events []string
+	var ids []string
+	trace := &ClientTrace{
+		DialStart:		func(id, target string) { ids = append(ids, id) },
+		ConnectStart:	func(proxy string) { events = append(events, "start "+proxy) },
+		ConnectDone:	func(proxy string, err error) { events = append(events, "done "+proxy) },
+		GotReply:		func(code ReplyCode, bound *Addr, err error) { events = append(events, "reply") },
+	}
+	ctx := WithClientTrace(context.Background(), trace)
+	d := Chain(
+		&Dialer{ProxyAddr: first, Timeout: 5 * time.Second},
+		&Dialer{ProxyAddr: second, Timeout: 5 * time.Second, Auth: &Auth{User: "user", Password: "secret"}},
+	)
+	conn, err := d.DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	mu.Lock()
+	if want := []string{"first " + second, "second " + echo}; strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("proxies got requests %q, want %q", requests, want)
+	}
+	mu.Unlock()
+	if len(ids) != 1 {
+		t.Fatalf("DialStart called with %q, want a single dial", ids)
+	}
+	if got := conn.(*Conn).DialID(); got != ids[0] {
+		t.Errorf("DialID() = %q, want %q", got, ids[0])
+	}
+	want := []string{"start " + second, "start " + first, "done " + first, "reply", "done " + second, "reply"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("got trace %q, want %q", events, want)
+	}
+
+	// an error from an inner hop carries the ID of the whole dial
+	ids = nil
+	d.ProxyAddr = "127.0.0.1:1"
+	_, err = d.DialContext(WithDialID(ctx, "req-7"), "tcp", echo)
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.ID != "req-7" || herr.Stage != StageDial {
+		t.Fatalf("got %v, want a dial stage error with ID req-7", err)
+	}
+	inner := errors.Unwrap(herr)
+	if !errors.As(inner, &herr) || herr.ID != "req-7" || herr.Proxy != first {
+		t.Errorf("got inner error %v, want one from %s with ID req-7", inner, first)
+	}
+	if len(ids) != 1 || ids[0] != "req-7" {
+		t.Errorf("DialStart called with %q, want [req-7]", ids)
+	}
+}
@@ -0,0 +1,198 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxUDPHeaderLen is the length of the longest possible SOCKS5 UDP request
+// header: RSV, FRAG, ATYP, a 255-byte domain name with its length, and PORT.
+const maxUDPHeaderLen = 2 + 1 + 1 + 1 + 0xFF + 2
+
+// ListenPacket issues a UDP ASSOCIATE request to the proxy, and returns a
+// PacketConn which relays datagrams through it.  The network must be "udp",
+// "udp4" or "udp6".  If address is not empty, it is the local address the UDP
+// socket is bound to.  The context only governs setting up the association;
+// the association lasts until the returned PacketConn is closed or the proxy
+// closes the control connection.
+func (d *Dialer) ListenPacket(ctx context.Context, network, address string) (*PacketConn, error) {
+	// we don't know which address our datagrams will come from as far as the
+	// proxy is concerned, so send all zeros as RFC 1928 says we should
+	anyAddr := &Addr{IP: net.IPv4zero}
+
+	var laddr *net.UDPAddr
+	switch network {
+		case "udp", "udp4", "udp6":
+		default:
+			return nil, newHandshakeError(StageDial, d.ProxyAddr, anyAddr.String(), net.UnknownNetworkError(network))
+	}
+	if address != "" {
+		var err error
+		laddr, err = net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, newHandshakeError(StageDial, d.ProxyAddr, anyAddr.String(), err)
+		}
+	}
+
+	ctrl, err := d.dial(ctx, network, CommandUDPAssociate, anyAddr)
+	if err != nil {
+		return nil, err
+	}
+	bound := ctrl.boundAddr
+
+	// the proxy may reply with an unspecified address, meaning "the address
+	// you reached me at"
+	relay := &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+	if relay.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.ProxyAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
+	}
+	conn, err := net.DialUDP(network, laddr, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, newHandshakeError(StageConnect, ctrl.proxy, anyAddr.String(), err).withID(ctrl.id)
+	}
+
+	c := &PacketConn{
+		ctrl:			ctrl,
+		conn:			conn,
+		relay:			relay,
+		disableIDNA:	d.DisableIDNA,
+	}
+	go c.watchCtrl()
+	return c, nil
+}
+
+// PacketConn is a net.PacketConn whose datagrams are relayed through a SOCKS5
+// proxy.  It is returned by Dialer.ListenPacket.
+type PacketConn struct {
+	ctrl	net.Conn		// TCP connection the association is tied to
+	conn	*net.UDPConn	// connected to the proxy's relay
+	relay	*net.UDPAddr
+
+	disableIDNA	bool	// from the Dialer
+
+	readMu		sync.Mutex
+	readBuf		[]byte
+	writeMu		sync.Mutex
+	writeBuf	[]byte
+}
+
+// watchCtrl waits until the proxy closes the control connection, which ends
+// the association, and then closes the UDP socket so that pending reads
+// return.
+func (c *PacketConn) watchCtrl() {
+	io.Copy(io.Discard, c.ctrl)
+	c.conn.Close()
+}
+
+// ReadFrom reads a datagram relayed by the proxy, and returns the address it
+// was sent from.  The address is a *net.UDPAddr, unless the proxy reported a
+// domain name, in which case it is an *Addr.  Fragmented datagrams are not
+// supported, and are silently discarded, as are malformed ones.
+func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.readBuf) < len(p)+maxUDPHeaderLen {
+		c.readBuf = make([]byte, len(p)+maxUDPHeaderLen)
+	}
+	for {
+		n, err := c.conn.Read(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		var hdr UDPHeader
+		hdrLen, err := hdr.Unmarshal(c.readBuf[:n])
+		// we don't do reassembly
+		if err != nil || hdr.Frag != 0 {
+			continue
+		}
+		src := hdr.Addr
+		n = copy(p, c.readBuf[hdrLen:n])
+		if src.IP != nil {
+			return n, &net.UDPAddr{IP: src.IP, Port: src.Port}, nil
+		}
+		return n, src, nil
+	}
+}
+
+// WriteTo sends p to addr through the proxy.  addr may be a *net.UDPAddr, an
+// *Addr, or any other net.Addr whose String method returns a host and a port
+// in the format expected by net.SplitHostPort.  Host names are converted to
+// ASCII as for Dial, unless the Dialer has DisableIDNA set.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	var dst *Addr
+	switch a := addr.(type) {
+		case *net.UDPAddr:
+			dst = &Addr{IP: a.IP, Port: a.Port}
+		case *Addr:
+			dst = a
+		default:
+			dst, err = parseAddr(addr.String())
+			if err != nil {
+				return 0, err
+			}
+	}
+	if !c.disableIDNA {
+		dst, err = asciiAddr(dst)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	hdr := UDPHeader{Addr: dst}
+	b, err := hdr.appendTo(c.writeBuf[:0])
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, p...)
+	c.writeBuf = b
+	_, err = c.conn.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the association, closing both the UDP socket and the control
+// connection to the proxy.
+func (c *PacketConn) Close() error {
+	err := c.conn.Close()
+	cerr := c.ctrl.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the UDP socket.
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RelayAddr returns the address of the proxy's UDP relay.
+func (c *PacketConn) RelayAddr() net.Addr {
+	return c.relay
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
@@ -0,0 +1,354 @@
+package socks
+
+import (
+	"io"
+	"strconv"
+)
+
+// The types in this file are the messages of the SOCKS5 protocol, as defined
+// in RFC 1928.  The client and server in this package use them, but they are
+// also useful on their own for tools which need to speak or inspect the
+// protocol.  Marshal and WriteTo encode a message, while Unmarshal decodes one
+// from the start of a buffer, and ReadFrom reads exactly one message from a
+// stream.
+
+// Command is the CMD field of a SOCKS5 request.
+type Command byte
+
+// Commands defined by RFC 1928.
+const (
+	CommandConnect		Command = 0x01
+	CommandBind			Command = 0x02
+	CommandUDPAssociate	Command = 0x03
+)
+
+// Commands added by Tor, see Dialer.ResolveHost and Dialer.ResolvePtr.
+const (
+	CommandResolve		Command = 0xF0
+	CommandResolvePtr	Command = 0xF1
+)
+
+func (c Command) String() string {
+	switch c {
+		case CommandConnect:
+			return "CONNECT"
+		case CommandBind:
+			return "BIND"
+		case CommandUDPAssociate:
+			return "UDP ASSOCIATE"
+		case CommandResolve:
+			return "RESOLVE"
+		case CommandResolvePtr:
+			return "RESOLVE_PTR"
+	}
+	return "command " + strconv.FormatUint(uint64(c), 16)
+}
+
+// Greeting is the version identifier/method selection message a client opens
+// the connection with.  It lists the authentication methods the client
+// supports.
+type Greeting struct {
+	Methods	[]byte
+}
+
+func (g *Greeting) appendTo(b []byte) ([]byte, error) {
+	if len(g.Methods) == 0 || len(g.Methods) > 0xFF {
+		return nil, ErrAuthMethods
+	}
+	b = append(b, socks5Version, byte(len(g.Methods)))
+	return append(b, g.Methods...), nil
+}
+
+// Marshal encodes g.  It fails with ErrAuthMethods unless g lists between 1
+// and 255 methods.
+func (g *Greeting) Marshal() ([]byte, error) {
+	return g.appendTo(nil)
+}
+
+// WriteTo writes the encoding of g to w in a single Write call.
+func (g *Greeting) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, g.appendTo)
+}
+
+// Unmarshal decodes the greeting at the start of b, and returns its length.
+func (g *Greeting) Unmarshal(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ErrShortMessage
+	}
+	if b[0] != socks5Version {
+		return 0, &ProtocolError{ErrVersion, b[0]}
+	}
+	n := 2 + int(b[1])
+	if len(b) < n {
+		return 0, ErrShortMessage
+	}
+	g.Methods = append([]byte(nil), b[2:n]...)
+	return n, nil
+}
+
+// ReadFrom reads a greeting from r.  It returns the number of bytes read.
+func (g *Greeting) ReadFrom(r io.Reader) (int64, error) {
+	var hdr [2]byte
+	n, err := readFull(r, hdr[:], false)
+	if err != nil {
+		return int64(n), err
+	}
+	if hdr[0] != socks5Version {
+		return int64(n), &ProtocolError{ErrVersion, hdr[0]}
+	}
+	methods := make([]byte, hdr[1])
+	m, err := readFull(r, methods, true)
+	g.Methods = methods[:m]
+	return int64(n + m), err
+}
+
+// MethodSelection is the server's answer to a Greeting: the authentication
+// method it selected, or 0xFF if none of the client's methods are acceptable.
+type MethodSelection struct {
+	Method	byte
+}
+
+func (m *MethodSelection) appendTo(b []byte) ([]byte, error) {
+	return append(b, socks5Version, m.Method), nil
+}
+
+// Marshal encodes m.
+func (m *MethodSelection) Marshal() ([]byte, error) {
+	return m.appendTo(nil)
+}
+
+// WriteTo writes the encoding of m to w in a single Write call.
+func (m *MethodSelection) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, m.appendTo)
+}
+
+// Unmarshal decodes the method selection message at the start of b, and
+// returns its length.  If the version is not 5, the error is ErrNotSocks5.
+func (m *MethodSelection) Unmarshal(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ErrShortMessage
+	}
+	if b[0] != socks5Version {
+		return 0, ErrNotSocks5
+	}
+	m.Method = b[1]
+	return 2, nil
+}
+
+// ReadFrom reads a method selection message from r.  It returns the number
+// of bytes read.
+func (m *MethodSelection) ReadFrom(r io.Reader) (int64, error) {
+	var b [2]byte
+	n, err := readFull(r, b[:], false)
+	if err != nil {
+		return int64(n), err
+	}
+	_, err = m.Unmarshal(b[:])
+	return int64(n), err
+}
+
+// Request is a request from the client, sent once authentication is done.
+// A nil Dst is encoded as the IPv4 address 0.0.0.0 and port 0.
+type Request struct {
+	Command	Command
+	Dst		*Addr
+}
+
+func (q *Request) appendTo(b []byte) ([]byte, error) {
+	b = append(b, socks5Version, byte(q.Command), 0x00)
+	return addrOrZero(q.Dst).appendTo(b)
+}
+
+// Marshal encodes q.  It fails with ErrHostnameTooLong if the name in Dst
+// does not fit, and with ErrInvalidAddr if Dst is not a valid address.
+func (q *Request) Marshal() ([]byte, error) {
+	return q.appendTo(nil)
+}
+
+// WriteTo writes the encoding of q to w in a single Write call.
+func (q *Request) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, q.appendTo)
+}
+
+// Unmarshal decodes the request at the start of b, and returns its length.
+func (q *Request) Unmarshal(b []byte) (int, error) {
+	cmd, dst, n, err := unmarshalHeader(b, ErrVersion)
+	if err != nil {
+		return 0, err
+	}
+	q.Command, q.Dst = Command(cmd), dst
+	return n, nil
+}
+
+// ReadFrom reads a request from r.  It returns the number of bytes read.
+func (q *Request) ReadFrom(r io.Reader) (int64, error) {
+	b, err := readHeader(r, ErrVersion, nil, nil)
+	if err != nil {
+		return int64(len(b)), err
+	}
+	_, err = q.Unmarshal(b)
+	return int64(len(b)), err
+}
+
+// Reply is the server's reply to a Request.  A nil Bound is encoded as the
+// IPv4 address 0.0.0.0 and port 0.
+type Reply struct {
+	Code	ReplyCode
+	Bound	*Addr
+}
+
+func (p *Reply) appendTo(b []byte) ([]byte, error) {
+	b = append(b, socks5Version, byte(p.Code), 0x00)
+	return addrOrZero(p.Bound).appendTo(b)
+}
+
+// Marshal encodes p.  It fails with ErrHostnameTooLong if the name in Bound
+// does not fit, and with ErrInvalidAddr if Bound is not a valid address.
+func (p *Reply) Marshal() ([]byte, error) {
+	return p.appendTo(nil)
+}
+
+// WriteTo writes the encoding of p to w in a single Write call.
+func (p *Reply) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, p.appendTo)
+}
+
+// Unmarshal decodes the reply at the start of b, and returns its length.  If
+// the version is not 5, the error wraps ErrReplyVersion.
+func (p *Reply) Unmarshal(b []byte) (int, error) {
+	code, bound, n, err := unmarshalHeader(b, ErrReplyVersion)
+	if err != nil {
+		return 0, err
+	}
+	p.Code, p.Bound = ReplyCode(code), bound
+	return n, nil
+}
+
+// ReadFrom reads a reply from r.  It returns the number of bytes read.  Code
+// is set as soon as it has been read, so that a refusal can be recognized
+// even if the rest of the reply is malformed or missing.
+func (p *Reply) ReadFrom(r io.Reader) (int64, error) {
+	return p.readFrom(r, nil)
+}
+
+// readFrom is ReadFrom, reading into b if it has enough capacity.
+func (p *Reply) readFrom(r io.Reader, b []byte) (int64, error) {
+	b, err := readHeader(r, ErrReplyVersion, &p.Code, b)
+	if err != nil {
+		return int64(len(b)), err
+	}
+	_, err = p.Unmarshal(b)
+	return int64(len(b)), err
+}
+
+// UDPHeader is the header of a datagram exchanged with the proxy's UDP relay.
+// Addr is the destination of datagrams sent to the relay, and the source of
+// datagrams received from it.  Frag is the fragment number, or 0 if the
+// datagram is not fragmented.  A nil Addr is encoded as the IPv4 address
+// 0.0.0.0 and port 0.
+type UDPHeader struct {
+	Frag	byte
+	Addr	*Addr
+}
+
+func (h *UDPHeader) appendTo(b []byte) ([]byte, error) {
+	b = append(b, 0x00, 0x00, h.Frag)
+	return addrOrZero(h.Addr).appendTo(b)
+}
+
+// Marshal encodes h.  The payload of the datagram follows the header.  It
+// fails like Request.Marshal if Addr cannot be encoded.
+func (h *UDPHeader) Marshal() ([]byte, error) {
+	return h.appendTo(nil)
+}
+
+// Unmarshal decodes the header at the start of the datagram b, and returns
+// its length; the rest of b is the payload.
+func (h *UDPHeader) Unmarshal(b []byte) (int, error) {
+	if len(b) < 3 {
+		return 0, ErrShortMessage
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return 0, &ProtocolError{ErrReservedByte, b[0] | b[1]}
+	}
+	addr, n, err := parseAddrField(b[3:])
+	if err != nil {
+		return 0, err
+	}
+	h.Frag, h.Addr = b[2], addr
+	return 3 + n, nil
+}
+
+// unmarshalHeader decodes the VER, CMD or REP, and RSV fields shared by
+// requests and replies, and the address following them.  versionErr is
+// reported if the version is wrong.
+func unmarshalHeader(b []byte, versionErr error) (byte, *Addr, int, error) {
+	if len(b) < 3 {
+		return 0, nil, 0, ErrShortMessage
+	}
+	if b[0] != socks5Version {
+		return 0, nil, 0, &ProtocolError{versionErr, b[0]}
+	}
+	if b[2] != 0x00 {
+		return 0, nil, 0, &ProtocolError{ErrReservedByte, b[2]}
+	}
+	addr, n, err := parseAddrField(b[3:])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return b[1], addr, 3 + n, nil
+}
+
+// readHeader reads a request or a reply from r, and returns its raw bytes.
+// The version is checked before reading any further, and reported as
+// versionErr if it is wrong.  If code is not nil, the second byte is stored
+// in it as soon as the version has been checked.  The message is read into b
+// if it has enough capacity.
+func readHeader(r io.Reader, versionErr error, code *ReplyCode, b []byte) ([]byte, error) {
+	if cap(b) < 3+maxAddrLen {
+		b = make([]byte, 0, 3+maxAddrLen)
+	}
+	b = b[:3]
+	n, err := readFull(r, b, false)
+	if err != nil {
+		return b[:n], err
+	}
+	if b[0] != socks5Version {
+		return b, &ProtocolError{versionErr, b[0]}
+	}
+	if code != nil {
+		*code = ReplyCode(b[1])
+	}
+	return readAddrField(r, b)
+}
+
+// readFull is io.ReadFull for reading a message from a connection.  If
+// started is set, part of the message has already been read, so that even an
+// io.EOF means the message was truncated.  Either way, truncation is reported
+// as errTruncated.
+func readFull(r io.Reader, b []byte, started bool) (int, error) {
+	n, err := io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && started) {
+		err = errTruncated
+	}
+	return n, err
+}
+
+// writeMessage encodes a message using appendTo, and writes it to w.
+func writeMessage(w io.Writer, appendTo func([]byte) ([]byte, error)) (int64, error) {
+	b, err := appendTo(nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+var zeroAddr = &Addr{IP: []byte{0, 0, 0, 0}}
+
+func addrOrZero(a *Addr) *Addr {
+	if a == nil {
+		return zeroAddr
+	}
+	return a
+}
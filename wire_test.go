@@ -0,0 +1,180 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// The fuzz targets below check that Unmarshal and ReadFrom agree on every
+// input, and that whatever they decode encodes back to the same message.
+
+// checkRead checks the results of ReadFrom on b against those of Unmarshal.
+func checkRead(t *testing.T, b []byte, n int, err error, readFrom func(io.Reader) (int64, error)) {
+	t.Helper()
+	r := bytes.NewReader(b)
+	m, rerr := readFrom(r)
+	switch {
+		case err == nil && rerr != nil:
+			t.Fatalf("Unmarshal decoded %d bytes, but ReadFrom failed: %v", n, rerr)
+		case err == nil && (m != int64(n) || r.Len() != len(b)-n):
+			t.Fatalf("Unmarshal decoded %d bytes, but ReadFrom read %d", n, len(b)-r.Len())
+		case err != nil && rerr == nil:
+			t.Fatalf("Unmarshal failed with %v, but ReadFrom succeeded", err)
+		case errors.Is(err, ErrShortMessage) && !errors.Is(rerr, ErrShortMessage) && !(len(b) == 0 && rerr == io.EOF):
+			t.Fatalf("Unmarshal found the message truncated, but ReadFrom failed with %v", rerr)
+	}
+}
+
+// sameAddr reports whether a and b are the same address.  IPv4-mapped IPv6
+// addresses are the same as the IPv4 addresses they map, as they are encoded
+// as IPv4 addresses.
+func sameAddr(a, b *Addr) bool {
+	return a.Name == b.Name && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func FuzzGreeting(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00})
+	f.Add([]byte{0x05, 0x03, 0x00, 0x01, 0x02})
+	f.Add([]byte{0x05, 0x00})
+	f.Add([]byte{0x04, 0x01, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var g Greeting
+		n, err := g.Unmarshal(b)
+		var g2 Greeting
+		checkRead(t, b, n, err, g2.ReadFrom)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(g.Methods, g2.Methods) {
+			t.Fatalf("Unmarshal got methods % x, ReadFrom % x", g.Methods, g2.Methods)
+		}
+
+		enc, err := g.Marshal()
+		if len(g.Methods) == 0 {
+			if !errors.Is(err, ErrAuthMethods) {
+				t.Fatalf("Marshal of an empty greeting: got %v, want ErrAuthMethods", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(enc, b[:n]) {
+			t.Fatalf("decoded % x, encoded back as % x", b[:n], enc)
+		}
+	})
+}
+
+func FuzzRequest(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50})
+	f.Add(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com\x01\xBB"...))
+	f.Add([]byte{0x05, 0xF0, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x00})
+	f.Add([]byte{0x05, 0x01, 0x00, 0x02})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var q Request
+		n, err := q.Unmarshal(b)
+		var q2 Request
+		checkRead(t, b, n, err, q2.ReadFrom)
+		if err != nil {
+			return
+		}
+		if q.Command != q2.Command || !sameAddr(q.Dst, q2.Dst) {
+			t.Fatalf("Unmarshal got %v %v, ReadFrom %v %v", q.Command, q.Dst, q2.Command, q2.Dst)
+		}
+		checkRoundtrip(t, q.Dst, q.Marshal, func(b []byte) (*Addr, error) {
+			var q3 Request
+			_, err := q3.Unmarshal(b)
+			if err == nil && q3.Command != q.Command {
+				t.Fatalf("command %v encoded back as %v", q.Command, q3.Command)
+			}
+			return q3.Dst, err
+		})
+	})
+}
+
+func FuzzReply(f *testing.F) {
+	f.Add([]byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x04, 0x38})
+	f.Add([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	f.Add(append([]byte{0x05, 0x00, 0x00, 0x03, 9}, "localhost\x00\x00"...))
+	f.Add([]byte{0x00, 0x5A, 0x00, 0x00, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var p Reply
+		n, err := p.Unmarshal(b)
+		var p2 Reply
+		checkRead(t, b, n, err, p2.ReadFrom)
+		if err != nil {
+			return
+		}
+		if p.Code != p2.Code || !sameAddr(p.Bound, p2.Bound) {
+			t.Fatalf("Unmarshal got %v %v, ReadFrom %v %v", p.Code, p.Bound, p2.Code, p2.Bound)
+		}
+		checkRoundtrip(t, p.Bound, p.Marshal, func(b []byte) (*Addr, error) {
+			var p3 Reply
+			_, err := p3.Unmarshal(b)
+			if err == nil && p3.Code != p.Code {
+				t.Fatalf("code %v encoded back as %v", p.Code, p3.Code)
+			}
+			return p3.Bound, err
+		})
+	})
+}
+
+func FuzzUDPHeader(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'd', 'n', 's'})
+	f.Add(append([]byte{0x00, 0x00, 0x01, 0x03, 4}, "test\x00\x07"...))
+	f.Add([]byte{0x00, 0x01, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var h UDPHeader
+		_, err := h.Unmarshal(b)
+		if err != nil {
+			return
+		}
+		checkRoundtrip(t, h.Addr, h.Marshal, func(b []byte) (*Addr, error) {
+			var h2 UDPHeader
+			_, err := h2.Unmarshal(b)
+			if err == nil && h2.Frag != h.Frag {
+				t.Fatalf("fragment %d encoded back as %d", h.Frag, h2.Frag)
+			}
+			return h2.Addr, err
+		})
+	})
+}
+
+// checkRoundtrip checks that a message decoded with the address addr encodes
+// back to one with the same address.
+func checkRoundtrip(t *testing.T, addr *Addr, marshal func() ([]byte, error), unmarshal func([]byte) (*Addr, error)) {
+	t.Helper()
+	enc, err := marshal()
+	if err != nil {
+		t.Fatalf("Marshal with %v: %v", addr, err)
+	}
+	got, err := unmarshal(enc)
+	if err != nil {
+		t.Fatalf("encoded % x, which failed to decode: %v", enc, err)
+	}
+	if !sameAddr(got, addr) {
+		t.Fatalf("address %v encoded back as %v", addr, got)
+	}
+}
+
+func TestUnmarshalIPv4Mapped(t *testing.T) {
+	// an IPv4-mapped IPv6 address decodes fine, but is encoded back as an
+	// IPv4 address
+	b := []byte{0x05, 0x00, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 10, 0, 0, 1, 0x00, 0x50}
+	var p Reply
+	_, err := p.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}
+	if !bytes.Equal(enc, want) || !p.Bound.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("%v encoded as % x, want % x", p.Bound, enc, want)
+	}
+}